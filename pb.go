@@ -1,6 +1,9 @@
 package progress
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/cheggaaa/pb"
 )
 
@@ -11,9 +14,34 @@ func UpdatePB(b **pb.ProgressBar, pt ProgressTracker) {
 
 	if *b == nil {
 		(*b) = pb.New(int(status.Total))
+		if status.Units == UnitBytes {
+			(*b).SetUnits(pb.U_BYTES)
+		}
 		(*b).Start()
 	}
 
 	(*b).Prefix(status.Stage)
+	(*b).Postfix(pbRate(status))
 	(*b).Set(int(status.Progress))
 }
+
+// pbRate describes the rate and ETA of a task for the postfix of a bar.
+func pbRate(status *Status) string {
+	if status.Rate <= 0 {
+		return ""
+	}
+
+	var s string
+	if status.Units == UnitBytes {
+		s = " " + pb.Format(int64(status.Rate)).To(pb.U_BYTES).PerSec().String()
+	} else {
+		s = fmt.Sprintf(" %.1f %s/s", status.Rate, status.Units)
+	}
+
+	if status.ETASeconds > 0 {
+		eta := time.Duration(status.ETASeconds * float64(time.Second))
+		s += " ETA " + eta.Round(time.Second).String()
+	}
+
+	return s
+}
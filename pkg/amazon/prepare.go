@@ -210,7 +210,6 @@ func importSnapshot(svc *ec2.EC2, bucket *string, key *string, format *string) (
 
 func waitUntilSnapshotImported(svc *ec2.EC2, importTaskID *string, pt progress.ProgressTracker) (*string, error) {
 	// fmt.Printf("waitUntilSnapshotImported\n")
-	initial := pt.Status().Progress
 	isImportingSnapshot := true
 	var snapshotID *string
 	for {
@@ -227,7 +226,7 @@ func waitUntilSnapshotImported(svc *ec2.EC2, importTaskID *string, pt progress.P
 				}
 				if st.ImportSnapshotTasks[i].SnapshotTaskDetail != nil && st.ImportSnapshotTasks[i].SnapshotTaskDetail.Progress != nil {
 					percentage, _ := strconv.ParseInt(*st.ImportSnapshotTasks[i].SnapshotTaskDetail.Progress, 10, 64)
-					pt.SetProgress(float64(percentage) + initial)
+					pt.SetProgress(float64(percentage))
 				}
 				// fmt.Printf("st [%d]: %s\n", i, st.ImportSnapshotTasks[i])
 				if aws.StringValue(st.ImportSnapshotTasks[i].SnapshotTaskDetail.Status) == "completed" {
@@ -244,7 +243,7 @@ func waitUntilSnapshotImported(svc *ec2.EC2, importTaskID *string, pt progress.P
 		time.Sleep(15 * time.Second)
 	}
 
-	pt.SetProgress(100 + initial)
+	pt.SetProgress(100)
 
 	return snapshotID, nil
 }
@@ -472,48 +471,56 @@ func uploadAndImport(svc *ec2.EC2, p *Provisioner, r io.ReadCloser, name string,
 }
 
 // Prepare creates an AMI from a ReadCloser r and names it name
-func (p *Provisioner) Prepare(r io.ReadCloser, name, description string, overwriteImage bool, pt progress.ProgressTracker) error {
+func (p *Provisioner) Prepare(r io.ReadCloser, name, description string, overwriteImage bool, pt progress.ProgressTracker) (err error) {
 
 	description = strings.TrimSpace(description)
 	if len(description) > 255 {
 		description = description[:255]
 	}
 
-	pt.Initialize("Provisioning Virtual Machine Image.", 105, progress.UnitStep)
+	stages := progress.NewWeightedStages(pt, "Provisioning Virtual Machine Image.",
+		progress.StageWeight{Name: "Checking account.", Weight: 5},
+		progress.StageWeight{Name: "Uploading image.", Weight: 45},
+		progress.StageWeight{Name: "Importing snapshot.", Weight: 45},
+		progress.StageWeight{Name: "Registering image.", Weight: 5},
+	)
+	defer func() { stages.Close(err) }()
 
-	pt.SetStage("Authenticating with Amazon servers.")
+	st := stages.Next()
+	st.Initialize("Checking account.", 3, progress.UnitStep)
+
+	st.SetStage("Authenticating with Amazon servers.")
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region:      p.region,
 		Credentials: p.credentials,
 	}))
 	svc := ec2.New(sess)
-	pt.IncrementProgress(1)
+	st.IncrementProgress(1)
 
 	// c := make(chan *string)
 	// go uploadAndImport(svc, p, r, name, c, pt)
 
-	pt.SetStage("Requesting owner ID.")
+	st.SetStage("Requesting owner ID.")
 	ownerID, err := getOwnerID(svc)
 	if err != nil {
 		return err
 	}
-	pt.IncrementProgress(1)
+	st.IncrementProgress(1)
 
-	pt.SetStage("Cheching if AMI already exists.")
+	st.SetStage("Cheching if AMI already exists.")
 	err = checkImageExists(svc, name, ownerID, overwriteImage)
 	if err != nil {
 		return err
 	}
-	pt.IncrementProgress(1)
+	st.IncrementProgress(1)
 
-	pt.SetStage("Provisioning.")
-	err = p.Provision(name, r)
+	err = p.ProvisionWithProgress(name, r, stages.Next())
 	if err != nil {
 		return err
 	}
-	pt.IncrementProgress(1)
 
-	pt.SetStage("Importing snapshot.")
+	it := stages.Next()
+	it.Initialize("Importing snapshot.", 100, progress.UnitPercent)
 	importTaskID, err := importSnapshot(svc, p.bucket, aws.String(name), p.format)
 	if err != nil {
 		return err
@@ -589,7 +596,7 @@ func (p *Provisioner) Prepare(r io.ReadCloser, name, description string, overwri
 	// if ok == false {
 	// 	return fmt.Errorf("Uploading or importing failed")
 	// }
-	snapshotID, err := waitUntilSnapshotImported(svc, importTaskID, pt)
+	snapshotID, err := waitUntilSnapshotImported(svc, importTaskID, it)
 	if err != nil {
 		return err
 	}
@@ -627,12 +634,13 @@ func (p *Provisioner) Prepare(r io.ReadCloser, name, description string, overwri
 	// }
 	// pt.IncrementProgress(1)
 
-	pt.SetStage("Regiestering image.")
+	rt := stages.Next()
+	rt.Initialize("Registering image.", 1, progress.UnitStep)
 	err = registerImage(svc, snapshotID, name, description)
 	if err != nil {
 		return err
 	}
-	pt.IncrementProgress(1)
+	rt.IncrementProgress(1)
 
 	return nil
 }
@@ -5,12 +5,16 @@ import (
 	"context"
 	"io"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/sisatech/progress"
 )
 
 // Provisioner ...
@@ -48,6 +52,59 @@ func NewProvisioner(cfg *Config) (*Provisioner, error) {
 
 // Provision ...
 func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
+	return p.ProvisionWithProgress(f, r, progress.NewProgressTracker())
+}
+
+// uploadBody is the body of an upload to S3, which reports how much of it
+// has been sent to pt. The signer reads the whole body to hash it before
+// any of it is sent, so nothing is reported until start is called once the
+// request has been signed, and nothing after stop.
+type uploadBody struct {
+	*bytes.Reader
+	pt progress.ProgressTracker
+
+	lock    sync.Mutex
+	sending bool
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.report()
+	return n, err
+}
+
+// Seek moves the position of the body, which is rewound when a request is
+// retried.
+func (b *uploadBody) Seek(offset int64, whence int) (int64, error) {
+	pos, err := b.Reader.Seek(offset, whence)
+	b.report()
+	return pos, err
+}
+
+func (b *uploadBody) report() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.sending {
+		b.pt.SetProgress(float64(b.Size() - int64(b.Len())))
+	}
+}
+
+func (b *uploadBody) start() {
+	b.lock.Lock()
+	b.sending = true
+	b.lock.Unlock()
+}
+
+func (b *uploadBody) stop() {
+	b.lock.Lock()
+	b.sending = false
+	b.lock.Unlock()
+}
+
+// ProvisionWithProgress is Provision, reporting the bytes sent to S3 to pt.
+// The image is read into memory first, as the upload must be able to seek
+// it.
+func (p *Provisioner) ProvisionWithProgress(f string, r io.ReadCloser, pt progress.ProgressTracker) error {
 
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region:      p.region,
@@ -71,18 +128,25 @@ func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
 	if err != nil {
 		return err
 	}
-	// convert to Reader
-	data := bytes.NewReader(b)
+	pt.Initialize("Uploading image.", float64(len(b)), progress.UnitBytes)
 
 	// Uploads the file f into the s3 bucket with the data contained within r.
-	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket: p.bucket,
-		Key:    aws.String(f),
+	return putObject(ctx, svc, p.bucket, aws.String(f), b, pt)
+}
+
+// putObject uploads b as the object key, reporting the bytes sent to pt.
+func putObject(ctx context.Context, svc *s3.S3, bucket, key *string, b []byte, pt progress.ProgressTracker) error {
+	data := &uploadBody{Reader: bytes.NewReader(b), pt: pt}
+	defer data.stop()
+
+	_, err := svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    key,
 		Body:   data,
+	}, func(req *request.Request) {
+		req.Handlers.Sign.PushBack(func(*request.Request) {
+			data.start()
+		})
 	})
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return err
 }
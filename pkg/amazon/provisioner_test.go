@@ -0,0 +1,97 @@
+package amazon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sisatech/progress"
+)
+
+func TestPutObjectReportsBytesSent(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int // requests answered with a server error before succeeding
+	}{
+		{"first attempt", 0},
+		{"retried", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// too large for the connection to buffer all of it before the
+			// server starts reading
+			data := bytes.Repeat([]byte("0123456789abcdef"), 2*1024*1024)
+			pt := progress.NewProgressTracker()
+			pt.Initialize("Uploading image.", float64(len(data)), progress.UnitBytes)
+
+			var lock sync.Mutex
+			var received [][]byte
+			var before []float64 // progress when each request arrived
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				before = append(before, pt.Status().Progress)
+				lock.Unlock()
+
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+
+				lock.Lock()
+				received = append(received, body)
+				attempt := len(received)
+				lock.Unlock()
+
+				if r.Method != "PUT" || r.URL.Path != "/bucket/image" {
+					t.Errorf("got %s %s", r.Method, r.URL.Path)
+				}
+				if attempt <= tt.failures {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			svc := s3.New(session.Must(session.NewSession(&aws.Config{
+				Region:           aws.String("us-east-1"),
+				Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+				Endpoint:         aws.String(srv.URL),
+				S3ForcePathStyle: aws.Bool(true),
+				MaxRetries:       aws.Int(tt.failures),
+			})))
+
+			err := putObject(context.Background(), svc, aws.String("bucket"), aws.String("image"), data, pt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(received) != tt.failures+1 {
+				t.Fatalf("got %d requests, want %d", len(received), tt.failures+1)
+			}
+			for i, body := range received {
+				if !bytes.Equal(body, data) {
+					t.Errorf("request %d: got %d bytes, want %d", i, len(body), len(data))
+				}
+				// hashing the body to sign the request is not progress, and a
+				// retry starts again from the beginning
+				if before[i] >= float64(len(data)) {
+					t.Errorf("request %d: reported %v bytes sent before it was read", i, before[i])
+				}
+			}
+
+			if got := pt.Status().Progress; got != float64(len(data)) {
+				t.Errorf("got progress %v, want %d", got, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package google
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// imageUserRole is the IAM role that allows a principal to create disks and
+// instances from an image without any other access to the owning project.
+const imageUserRole = "roles/compute.imageUser"
+
+// IAM member prefixes that an image may be shared with. The project
+// principals, e.g. "projectViewer:my-project", cover every member holding
+// that basic role on another project.
+var sharePrefixes = []string{"user:", "group:", "serviceAccount:", "domain:", "projectViewer:", "projectEditor:", "projectOwner:"}
+
+func validateMembers(members []string) error {
+	for _, m := range members {
+		valid := false
+		for _, prefix := range sharePrefixes {
+			if strings.HasPrefix(m, prefix) && len(m) > len(prefix) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid IAM member '%s'", m)
+		}
+	}
+	return nil
+}
+
+func checkImageExists(comp *compute.Service, project string, name string, overwrite bool) error {
+	_, err := comp.Images.Get(project, name).Do()
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	if !overwrite {
+		return fmt.Errorf("image '%s' already exists", name)
+	}
+
+	return deleteImage(comp, project, name)
+}
+
+func deleteImage(comp *compute.Service, project string, name string) error {
+	op, err := comp.Images.Delete(project, name).Do()
+	if err != nil {
+		return err
+	}
+
+	return waitUntilOperationDone(comp, project, op)
+}
+
+func waitUntilOperationDone(comp *compute.Service, project string, op *compute.Operation) error {
+	var err error
+	for op.Status != "DONE" {
+		time.Sleep(5 * time.Second)
+		op, err = comp.GlobalOperations.Get(project, op.Name).Do()
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("%s", op.Error.Errors[0].Message)
+	}
+
+	return nil
+}
+
+func waitUntilImageReady(comp *compute.Service, project string, name string) error {
+	for {
+		img, err := comp.Images.Get(project, name).Do()
+		if err != nil {
+			return err
+		}
+
+		switch img.Status {
+		case "READY":
+			return nil
+		case "FAILED":
+			return fmt.Errorf("image '%s' failed to import", name)
+		}
+		time.Sleep(15 * time.Second)
+	}
+}
+
+// updateImageUsers adds or removes members from the imageUser binding of an
+// image's IAM policy, leaving all other bindings untouched.
+func updateImageUsers(comp *compute.Service, project string, name string, members []string, grant bool) error {
+	// a policy read at an older version has its conditional bindings
+	// rewritten, and writing it back would lose their conditions
+	policy, err := comp.Images.GetIamPolicy(project, name).OptionsRequestedPolicyVersion(3).Do()
+	if err != nil {
+		return err
+	}
+
+	var binding *compute.Binding
+	for _, b := range policy.Bindings {
+		if b.Role == imageUserRole && b.Condition == nil {
+			binding = b
+			break
+		}
+	}
+
+	if binding == nil {
+		if !grant {
+			return nil
+		}
+		binding = &compute.Binding{Role: imageUserRole}
+		policy.Bindings = append(policy.Bindings, binding)
+	}
+
+	for _, m := range members {
+		idx := -1
+		for i, existing := range binding.Members {
+			if existing == m {
+				idx = i
+				break
+			}
+		}
+
+		if grant && idx < 0 {
+			binding.Members = append(binding.Members, m)
+		} else if !grant && idx >= 0 {
+			binding.Members = append(binding.Members[:idx], binding.Members[idx+1:]...)
+		}
+	}
+
+	// an empty binding is rejected by the API
+	if len(binding.Members) == 0 {
+		for i, b := range policy.Bindings {
+			if b == binding {
+				policy.Bindings = append(policy.Bindings[:i], policy.Bindings[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// the policy keeps the version it was read at
+	_, err = comp.Images.SetIamPolicy(project, name, &compute.GlobalSetPolicyRequest{
+		Policy: policy,
+	}).Do()
+	return err
+}
+
+// ShareImage grants roles/compute.imageUser on the image name to members.
+// Members use the IAM format, e.g. "group:builds@example.com",
+// "serviceAccount:123456789-compute@developer.gserviceaccount.com" or, to
+// share with another project, "projectViewer:other-project".
+func (p *Provisioner) ShareImage(name string, members []string) error {
+	err := validateMembers(members)
+	if err != nil {
+		return err
+	}
+
+	comp, err := compute.New(p.credentials.Client(p.ctx))
+	if err != nil {
+		return err
+	}
+
+	return updateImageUsers(comp, p.key.ProjectID, name, members, true)
+}
+
+// RevokeImage removes members previously granted access to the image name by
+// ShareImage or Prepare.
+func (p *Provisioner) RevokeImage(name string, members []string) error {
+	err := validateMembers(members)
+	if err != nil {
+		return err
+	}
+
+	comp, err := compute.New(p.credentials.Client(p.ctx))
+	if err != nil {
+		return err
+	}
+
+	return updateImageUsers(comp, p.key.ProjectID, name, members, false)
+}
+
+// Prepare creates a GCE image from a ReadCloser r and names it name. The
+// image is shared with each of shareWith (see ShareImage) once it is ready.
+func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool, shareWith []string) error {
+
+	err := validateMembers(shareWith)
+	if err != nil {
+		return err
+	}
+
+	comp, err := compute.New(p.credentials.Client(p.ctx))
+	if err != nil {
+		return err
+	}
+
+	err = checkImageExists(comp, p.key.ProjectID, name, overwriteImage)
+	if err != nil {
+		return err
+	}
+
+	err = p.Provision(name, r)
+	if err != nil {
+		return err
+	}
+
+	err = waitUntilImageReady(comp, p.key.ProjectID, name)
+	if err != nil {
+		return err
+	}
+
+	if len(shareWith) > 0 {
+		err = updateImageUsers(comp, p.key.ProjectID, name, shareWith, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package google
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestValidateMembers(t *testing.T) {
+	tests := []struct {
+		members []string
+		err     string
+	}{
+		{nil, ""},
+		{[]string{"user:a@example.com", "group:builds@example.com", "serviceAccount:1-compute@developer.gserviceaccount.com"}, ""},
+		{[]string{"domain:example.com", "projectViewer:other", "projectEditor:other", "projectOwner:other"}, ""},
+		{[]string{"user:a@example.com", "user:"}, "invalid IAM member 'user:'"},
+		{[]string{"allUsers"}, "invalid IAM member 'allUsers'"},
+		{[]string{"a@example.com"}, "invalid IAM member 'a@example.com'"},
+	}
+
+	for _, tt := range tests {
+		err := validateMembers(tt.members)
+		if (err == nil) != (tt.err == "") || err != nil && err.Error() != tt.err {
+			t.Errorf("%v: got error %v, want %q", tt.members, err, tt.err)
+		}
+	}
+}
+
+// testPolicyServer serves the IAM policy of a single image, recording the
+// policy set on it.
+type testPolicyServer struct {
+	t       *testing.T
+	policy  *compute.Policy
+	version string          // policy version requested by the last get
+	set     *compute.Policy // policy set, if any
+}
+
+func (s *testPolicyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const image = "/projects/project/global/images/image/"
+
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, image+"getIamPolicy"):
+		s.version = r.URL.Query().Get("optionsRequestedPolicyVersion")
+		json.NewEncoder(w).Encode(s.policy)
+
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, image+"setIamPolicy"):
+		req := new(compute.GlobalSetPolicyRequest)
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			s.t.Error(err)
+		}
+		s.set = req.Policy
+		json.NewEncoder(w).Encode(req.Policy)
+
+	default:
+		s.t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUpdateImageUsers(t *testing.T) {
+	owners := &compute.Binding{Role: "roles/owner", Members: []string{"user:owner@example.com"}}
+	conditional := &compute.Binding{
+		Role:      imageUserRole,
+		Members:   []string{"user:c@example.com"},
+		Condition: &compute.Expr{Title: "expires", Expression: `request.time < timestamp("2030-01-01T00:00:00Z")`},
+	}
+	users := func(members ...string) *compute.Binding {
+		return &compute.Binding{Role: imageUserRole, Members: members}
+	}
+	policy := func(version int64, bindings ...*compute.Binding) *compute.Policy {
+		return &compute.Policy{Version: version, Etag: "BwWKmjvelug=", Bindings: bindings}
+	}
+
+	tests := []struct {
+		name    string
+		policy  *compute.Policy
+		members []string
+		grant   bool
+		want    *compute.Policy // nil if the policy is left alone
+	}{{
+		name:    "grant without a binding",
+		policy:  policy(1, owners),
+		members: []string{"user:a@example.com"},
+		grant:   true,
+		want:    policy(1, owners, users("user:a@example.com")),
+	}, {
+		name:    "grant to a binding",
+		policy:  policy(1, users("user:a@example.com"), owners),
+		members: []string{"user:a@example.com", "group:g@example.com"},
+		grant:   true,
+		want:    policy(1, users("user:a@example.com", "group:g@example.com"), owners),
+	}, {
+		name:    "grant beside a conditional binding",
+		policy:  policy(3, conditional),
+		members: []string{"user:a@example.com"},
+		grant:   true,
+		want:    policy(3, conditional, users("user:a@example.com")),
+	}, {
+		name:    "revoke",
+		policy:  policy(3, users("user:a@example.com", "user:b@example.com"), conditional),
+		members: []string{"user:a@example.com", "user:x@example.com"},
+		want:    policy(3, users("user:b@example.com"), conditional),
+	}, {
+		name:    "revoke the last member",
+		policy:  policy(1, users("user:a@example.com"), owners),
+		members: []string{"user:a@example.com"},
+		want:    policy(1, owners),
+	}, {
+		name:    "revoke without a binding",
+		policy:  policy(3, owners, conditional),
+		members: []string{"user:c@example.com"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testPolicyServer{t: t, policy: tt.policy}
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			comp, err := compute.New(srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			comp.BasePath = srv.URL + "/compute/v1/projects/"
+
+			err = updateImageUsers(comp, "project", "image", tt.members, tt.grant)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s.version != "3" {
+				t.Errorf("got policy version %q requested, want 3", s.version)
+			}
+			if !reflect.DeepEqual(s.set, tt.want) {
+				got, _ := json.Marshal(s.set)
+				want, _ := json.Marshal(tt.want)
+				t.Errorf("got policy set\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -70,8 +70,10 @@ func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
 		return err
 	}
 
+	object := f + ".tar.gz"
+
 	bkt := stor.Bucket(p.bucket)
-	obj := bkt.Object("name.tar.gz")
+	obj := bkt.Object(object)
 	w := obj.NewWriter(p.ctx)
 
 	_, err = io.Copy(w, r)
@@ -85,9 +87,9 @@ func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
 	}
 
 	_, err = comp.Images.Insert(p.key.ProjectID, &compute.Image{
-		Name: "name",
+		Name: f,
 		RawDisk: &compute.ImageRawDisk{
-			Source: fmt.Sprintf("https://storage.googleapis.com/%s/%s", p.bucket, "name.tar.gz"),
+			Source: fmt.Sprintf("https://storage.googleapis.com/%s/%s", p.bucket, object),
 		},
 	}).Do()
 	if err != nil {
@@ -0,0 +1,102 @@
+package upload
+
+import (
+	"sync"
+
+	"github.com/sisatech/progress"
+)
+
+// Job uploads one chunk and returns the progress it accounts for, in the
+// units of the Pool's tracker.
+type Job func() (int64, error)
+
+// Pool runs Jobs on concurrent workers. The first failure stops the pool:
+// workers stop taking jobs and Submit refuses new ones. Progress is reported
+// to the tracker from a single goroutine, in the order jobs finish.
+type Pool struct {
+	jobs     chan Job
+	advanced chan int64
+	failed   chan struct{}
+	reported chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+	err      error
+}
+
+// NewPool starts workers workers that report progress to pt.
+func NewPool(workers int, pt progress.ProgressTracker) *Pool {
+	p := &Pool{
+		jobs:     make(chan Job),
+		advanced: make(chan int64),
+		failed:   make(chan struct{}),
+		reported: make(chan struct{}),
+	}
+
+	go func() {
+		for n := range p.advanced {
+			pt.IncrementProgress(float64(n))
+		}
+		close(p.reported)
+	}()
+
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				n, err := job()
+				if err != nil {
+					p.Fail(err)
+					return
+				}
+				if n > 0 {
+					p.advanced <- n
+				}
+			}
+		}()
+	}
+
+	return p
+}
+
+// Fail stops the pool with err, unless it has already failed.
+func (p *Pool) Fail(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.failed)
+	})
+}
+
+// Submit queues job, waiting for a free worker. It returns false, without
+// queueing job, once the pool has failed.
+func (p *Pool) Submit(job Job) bool {
+	select {
+	case <-p.failed:
+		return false
+	default:
+	}
+
+	select {
+	case p.jobs <- job:
+		return true
+	case <-p.failed:
+		return false
+	}
+}
+
+// Advance reports progress that needed no job, such as a chunk that did not
+// have to be uploaded.
+func (p *Pool) Advance(n int64) {
+	p.advanced <- n
+}
+
+// Wait stops taking jobs, waits for the workers to finish those queued and
+// for their progress to be reported, and returns the error the pool failed
+// with, if any. It must be called exactly once, after the last Submit.
+func (p *Pool) Wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	close(p.advanced)
+	<-p.reported
+	return p.err
+}
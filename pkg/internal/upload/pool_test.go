@@ -0,0 +1,58 @@
+package upload
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sisatech/progress"
+)
+
+func TestPool(t *testing.T) {
+	pt := progress.NewProgressTracker()
+	pt.Initialize("Uploading.", 100, progress.UnitBytes)
+
+	pool := NewPool(4, pt)
+	for i := 0; i < 10; i++ {
+		if !pool.Submit(func() (int64, error) { return 9, nil }) {
+			t.Fatal("job refused")
+		}
+	}
+	pool.Advance(10)
+
+	err := pool.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.Status().Progress; got != 100 {
+		t.Errorf("got progress %v, want 100", got)
+	}
+}
+
+func TestPoolFail(t *testing.T) {
+	pt := progress.NewProgressTracker()
+	pt.Initialize("Uploading.", 100, progress.UnitBytes)
+
+	failure := errors.New("failed")
+	var succeeded int32
+	pool := NewPool(2, pt)
+	pool.Submit(func() (int64, error) { return 0, failure })
+
+	// the pool refuses jobs once it has failed
+	for pool.Submit(func() (int64, error) {
+		atomic.AddInt32(&succeeded, 1)
+		return 1, nil
+	}) {
+	}
+	if pool.Submit(func() (int64, error) { return 0, nil }) {
+		t.Error("job accepted after the pool failed")
+	}
+
+	err := pool.Wait()
+	if err != failure {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+	if got, want := pt.Status().Progress, float64(atomic.LoadInt32(&succeeded)); got != want {
+		t.Errorf("got progress %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+// Package upload holds the pieces shared by the backends that upload
+// images in parallel chunks: sizing the input, retrying transient failures
+// and running a pool of upload workers.
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SourceSize returns the number of bytes remaining in r, or -1 if it cannot
+// be determined without reading r.
+func SourceSize(r io.Reader) int64 {
+	switch x := r.(type) {
+	case interface{ Len() int }:
+		return int64(x.Len())
+	case *os.File:
+		fi, err := x.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := x.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - pos
+	}
+	return -1
+}
+
+// StatusError reports an unexpected HTTP status code.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad status code %d", e.StatusCode)
+}
+
+// HTTPStatus returns the status code of the response.
+func (e *StatusError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+// Retryable reports whether a request that failed with err might succeed if
+// it is sent again. That is the case for network errors and for responses
+// with status 429 or 5xx; any other response means the request itself is at
+// fault. Errors that carry a status implement HTTPStatus() int, as
+// StatusError does.
+func Retryable(err error) bool {
+	var status interface{ HTTPStatus() int }
+	if errors.As(err, &status) {
+		code := status.HTTPStatus()
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Retry calls fn until it succeeds, it fails with an error that is not
+// Retryable, or it has been called attempts times. It waits delay before
+// the second call and twice as long before each call after that. The error
+// from the last call is returned.
+func Retry(attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = fn()
+		if err == nil || !Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceSize(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(make([]byte, 100))
+	f.Seek(40, io.SeekStart)
+
+	tests := []struct {
+		name string
+		r    io.Reader
+		want int64
+	}{
+		{"buffer", bytes.NewBufferString("hello"), 5},
+		{"reader", strings.NewReader("hello, world"), 12},
+		{"file", f, 60},
+		{"unknown", io.MultiReader(strings.NewReader("hello")), -1},
+	}
+	for _, tt := range tests {
+		if got := SourceSize(tt.r); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"429", &StatusError{StatusCode: 429}, true},
+		{"500", &StatusError{StatusCode: 500}, true},
+		{"503", &StatusError{StatusCode: 503}, true},
+		{"400", &StatusError{StatusCode: 400}, false},
+		{"403", &StatusError{StatusCode: 403}, false},
+		{"404", &StatusError{StatusCode: 404}, false},
+		{"url", &url.Error{Op: "Put", URL: "http://x", Err: errors.New("connection reset")}, true},
+		{"net", &net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{"truncated", io.ErrUnexpectedEOF, true},
+		{"other", errors.New("bad request body"), false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	transient := &StatusError{StatusCode: 503}
+	permanent := &StatusError{StatusCode: 400}
+
+	tests := []struct {
+		name  string
+		errs  []error // returned by successive calls; nil once exhausted
+		calls int
+		err   error
+	}{
+		{"success", nil, 1, nil},
+		{"transient then success", []error{transient, transient}, 3, nil},
+		{"permanent", []error{permanent, nil}, 1, permanent},
+		{"transient then permanent", []error{transient, permanent}, 2, permanent},
+		{"exhausted", []error{transient, transient, transient, transient}, 3, transient},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := Retry(3, time.Millisecond, func() error {
+			calls++
+			if calls <= len(tt.errs) {
+				return tt.errs[calls-1]
+			}
+			return nil
+		})
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: got %d calls, want %d", tt.name, calls, tt.calls)
+		}
+	}
+}
+
+func TestRetryNoSleepAfterLastAttempt(t *testing.T) {
+	start := time.Now()
+	Retry(1, time.Hour, func() error {
+		return &StatusError{StatusCode: 503}
+	})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %v", d)
+	}
+
+	start = time.Now()
+	Retry(5, time.Hour, func() error {
+		return &StatusError{StatusCode: 400}
+	})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %v", d)
+	}
+}
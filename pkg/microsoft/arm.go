@@ -0,0 +1,269 @@
+package microsoft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPollInterval is how long to wait between polls of a long-running
+// operation that does not provide a Retry-After header.
+const defaultPollInterval = 15 * time.Second
+
+// ARMError is an error reported by Azure Resource Manager, either in the
+// response to a request or as the outcome of a long-running operation.
+type ARMError struct {
+	StatusCode int        `json:"-"`
+	Code       string     `json:"code"`
+	Message    string     `json:"message"`
+	Target     string     `json:"target,omitempty"`
+	Details    []ARMError `json:"details,omitempty"`
+}
+
+func (e *ARMError) Error() string {
+	s := e.Code + ": " + e.Message
+	if e.Target != "" {
+		s += " (" + e.Target + ")"
+	}
+	for _, d := range e.Details {
+		s += "; " + d.Error()
+	}
+	return s
+}
+
+type armErrorResponseStruct struct {
+	Error *ARMError `json:"error"`
+}
+
+type armOperationStatusStruct struct {
+	Status string    `json:"status"`
+	Error  *ARMError `json:"error"`
+}
+
+type armProvisioningStateStruct struct {
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+	} `json:"properties"`
+}
+
+// newARMError returns the error described in the body of a failed response,
+// or a generic error if the body does not contain one.
+func newARMError(statusCode int, body []byte) error {
+	r := new(armErrorResponseStruct)
+	if json.Unmarshal(body, r) == nil && r.Error != nil && r.Error.Code != "" {
+		r.Error.StatusCode = statusCode
+		return r.Error
+	}
+	return &ARMError{
+		StatusCode: statusCode,
+		Code:       strconv.Itoa(statusCode),
+		Message:    fmt.Sprintf("bad status code %d", statusCode),
+	}
+}
+
+// isNotFound reports whether err is an ARM error for a missing resource.
+func isNotFound(err error) bool {
+	e, ok := err.(*ARMError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// armRequest sends a request to Resource Manager and returns the response
+// along with its body, or an ARMError if the status is not 2xx.
+func armRequest(p *Provisioner, verb string, url string, data interface{}) (*http.Response, []byte, error) {
+	resp, err := sendRestRequest(p, verb, url, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, newARMError(resp.StatusCode, bodyBytes)
+	}
+
+	return resp, bodyBytes, nil
+}
+
+// retryAfter returns the poll interval requested by resp.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return defaultPollInterval
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultPollInterval
+}
+
+// armOperation sends a request to Resource Manager and, if it starts a
+// long-running operation, waits for it to finish. The status of the
+// operation is tracked through the Azure-AsyncOperation header, the Location
+// header, or the provisioningState of the resource, in that order of
+// preference. The body of the final resource or result is returned.
+func armOperation(p *Provisioner, verb string, url string, data interface{}) ([]byte, error) {
+	return armOperationWithPoll(p, verb, url, data, nil)
+}
+
+// armOperationWithPoll is armOperation, calling poll, if it is not nil,
+// each time the status of a long-running operation has been checked. An
+// error from poll ends the wait.
+func armOperationWithPoll(p *Provisioner, verb string, url string, data interface{}, poll func() error) ([]byte, error) {
+	resp, body, err := armRequest(p, verb, url, data)
+	if err != nil {
+		return nil, err
+	}
+
+	asyncURL := resp.Header.Get("Azure-AsyncOperation")
+	locationURL := resp.Header.Get("Location")
+
+	switch {
+	case asyncURL != "":
+		err = pollAsyncOperation(p, asyncURL, retryAfter(resp), poll)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case verb == "PUT" || verb == "PATCH":
+			_, body, err = armRequest(p, "GET", url, nil)
+			return body, err
+		case verb == "POST" && locationURL != "":
+			_, body, err = armRequest(p, "GET", locationURL, nil)
+			return body, err
+		}
+		return nil, nil
+
+	case locationURL != "" && resp.StatusCode == http.StatusAccepted:
+		return pollLocationOperation(p, locationURL, retryAfter(resp), poll)
+
+	case verb == "PUT" || verb == "PATCH":
+		return pollProvisioningState(p, url, body, retryAfter(resp), poll)
+	}
+
+	return body, nil
+}
+
+func callPoll(poll func() error) error {
+	if poll == nil {
+		return nil
+	}
+	return poll()
+}
+
+// pollAsyncOperation polls an Azure-AsyncOperation URL until the operation
+// reaches a terminal status.
+func pollAsyncOperation(p *Provisioner, url string, wait time.Duration, poll func() error) error {
+	for {
+		time.Sleep(wait)
+
+		resp, body, err := armRequest(p, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		status := new(armOperationStatusStruct)
+		err = json.Unmarshal(body, status)
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToLower(status.Status) {
+		case "succeeded":
+			return nil
+		case "failed", "canceled":
+			if status.Error != nil {
+				status.Error.StatusCode = resp.StatusCode
+				return status.Error
+			}
+			return &ARMError{
+				StatusCode: resp.StatusCode,
+				Code:       status.Status,
+				Message:    "operation " + strings.ToLower(status.Status),
+			}
+		}
+
+		err = callPoll(poll)
+		if err != nil {
+			return err
+		}
+
+		wait = retryAfter(resp)
+	}
+}
+
+// pollLocationOperation polls a Location URL until it stops returning 202
+// Accepted, and returns the body of the final response.
+func pollLocationOperation(p *Provisioner, url string, wait time.Duration, poll func() error) ([]byte, error) {
+	for {
+		time.Sleep(wait)
+
+		resp, body, err := armRequest(p, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusAccepted {
+			return body, nil
+		}
+
+		err = callPoll(poll)
+		if err != nil {
+			return nil, err
+		}
+
+		wait = retryAfter(resp)
+	}
+}
+
+// pollProvisioningState polls the resource at url until its provisioning
+// state is terminal. body is the most recent representation of the resource.
+func pollProvisioningState(p *Provisioner, url string, body []byte, wait time.Duration, poll func() error) ([]byte, error) {
+	for {
+		state := new(armProvisioningStateStruct)
+		err := json.Unmarshal(body, state)
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(state.Properties.ProvisioningState) {
+		case "", "succeeded":
+			return body, nil
+		case "failed", "canceled":
+			return nil, &ARMError{
+				StatusCode: http.StatusOK,
+				Code:       state.Properties.ProvisioningState,
+				Message:    "provisioning " + strings.ToLower(state.Properties.ProvisioningState),
+			}
+		}
+
+		time.Sleep(wait)
+
+		var resp *http.Response
+		resp, body, err = armRequest(p, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		err = callPoll(poll)
+		if err != nil {
+			return nil, err
+		}
+
+		wait = retryAfter(resp)
+	}
+}
@@ -0,0 +1,291 @@
+package microsoft
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	managementResource = "https://management.azure.com/"
+	managementScope    = "https://management.azure.com/.default"
+	imdsTokenURL       = "http://169.254.169.254/metadata/identity/oauth2/token"
+	clientAssertion    = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// tokens are refreshed this long before they expire so that requests
+	// made during long polling loops never carry a stale token.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+// tokenSource fetches Azure AD access tokens for the Resource Manager API
+// using whichever identity the Config describes, and caches them until they
+// are close to expiry.
+type tokenSource struct {
+	cfg    *Config
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+}
+
+func newTokenSource(cfg *Config) (*tokenSource, error) {
+	t := &tokenSource{cfg: cfg}
+
+	if cfg.ManagedIdentity {
+		return t, nil
+	}
+
+	if cfg.TenantID == "" || cfg.ClientID == "" {
+		return nil, errors.New("tenant ID and client ID are required unless using a managed identity")
+	}
+
+	switch {
+	case cfg.ClientSecret != "":
+	case cfg.Certificate != "":
+		err := t.loadCertificate(cfg.Certificate)
+		if err != nil {
+			return nil, err
+		}
+	case cfg.FederatedTokenFile != "":
+	default:
+		return nil, errors.New("no client secret, certificate or federated token file configured")
+	}
+
+	return t, nil
+}
+
+// loadCertificate reads a PEM file containing the client certificate and its
+// unencrypted RSA private key.
+func (t *tokenSource) loadCertificate(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if t.cert == nil {
+				t.cert, err = x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return err
+				}
+			}
+		case "RSA PRIVATE KEY":
+			t.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			t.key, ok = k.(*rsa.PrivateKey)
+			if !ok {
+				return fmt.Errorf("certificate key in '%s' is not an RSA key", path)
+			}
+		}
+	}
+
+	if t.cert == nil || t.key == nil {
+		return fmt.Errorf("'%s' must contain a certificate and its private key", path)
+	}
+
+	return nil
+}
+
+// Token returns a valid access token, requesting a new one if the cached
+// token is missing or about to expire.
+func (t *tokenSource) Token() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token != "" && time.Now().Add(tokenRefreshMargin).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	var tr *tokenResponse
+	var err error
+	if t.cfg.ManagedIdentity {
+		tr, err = t.managedIdentityToken()
+	} else {
+		tr, err = t.clientCredentialsToken()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	expiresIn, err := tr.ExpiresIn.Int64()
+	if err != nil {
+		return "", fmt.Errorf("bad token expiry '%s'", tr.ExpiresIn)
+	}
+
+	t.token = tr.AccessToken
+	t.expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+
+	return t.token, nil
+}
+
+func (t *tokenSource) clientCredentialsToken() (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", t.cfg.ClientID)
+	form.Set("scope", managementScope)
+
+	tokenURL := "https://login.microsoftonline.com/" + t.cfg.TenantID + "/oauth2/v2.0/token"
+
+	switch {
+	case t.cfg.ClientSecret != "":
+		form.Set("client_secret", t.cfg.ClientSecret)
+	case t.cert != nil:
+		assertion, err := t.signAssertion(tokenURL)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_assertion_type", clientAssertion)
+		form.Set("client_assertion", assertion)
+	default:
+		// the federated token is rotated on disk by the platform, so it is
+		// re-read on every refresh
+		assertion, err := ioutil.ReadFile(t.cfg.FederatedTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_assertion_type", clientAssertion)
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	}
+
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return doTokenRequest(req)
+}
+
+func (t *tokenSource) managedIdentityToken() (*tokenResponse, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", managementResource)
+	if t.cfg.ClientID != "" {
+		// selects a user-assigned identity
+		query.Set("client_id", t.cfg.ClientID)
+	}
+
+	req, err := http.NewRequest("GET", imdsTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	return doTokenRequest(req)
+}
+
+func doTokenRequest(req *http.Request) (*tokenResponse, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := new(tokenResponse)
+	err = json.Unmarshal(bodyBytes, tr)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if err == nil && tr.Error != "" {
+			return nil, fmt.Errorf("authorisation failed: %s: %s", tr.Error, tr.ErrorDescription)
+		}
+		return nil, fmt.Errorf("authorisation failed: bad status code %d", resp.StatusCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.AccessToken == "" {
+		return nil, errors.New("authorisation failed: no access token returned")
+	}
+
+	return tr, nil
+}
+
+// signAssertion builds the RS256 JWT client assertion used to authenticate
+// with a certificate credential.
+func (t *tokenSource) signAssertion(audience string) (string, error) {
+	thumbprint := sha1.Sum(t.cert.Raw)
+
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+
+	header, err := json.Marshal(map[string]interface{}{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": t.cfg.ClientID,
+		"sub": t.cfg.ClientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now,
+		"exp": now + 600,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
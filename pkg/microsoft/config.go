@@ -2,10 +2,20 @@ package microsoft
 
 // Config ...
 type Config struct {
-	StorageAccount string // Name of the storage account
+	StorageAccount string // Name of the storage account. Not needed with DirectUpload.
 	StorageKey     string // Access key of storage account. There are two keys under access keys incase one needs to be revoked.
-	Container      string // Name of the existing container or container to be created.
+	SASToken       string // Account shared access signature, used instead of StorageKey. Must permit creating containers and writing blobs.
+	Container      string // Name of the existing container or container to be created. Not needed with DirectUpload.
+	DirectUpload   bool   // Upload into a managed disk instead of a page blob in the storage account
 	Location       string // Region that the image is to be provisioned in
 	ResourceGroup  string // ResourceGroup to deploy the image to
 	SubID          string // The subscription ID of the account
+	UploadWorkers  int    // Number of page ranges uploaded concurrently. Defaults to 8.
+
+	TenantID           string // Azure AD tenant (directory) ID
+	ClientID           string // Application (client) ID of the service principal, or of a user-assigned managed identity
+	ClientSecret       string // Client secret of the service principal
+	Certificate        string // Path to a PEM file holding the service principal's certificate and RSA private key, used instead of ClientSecret
+	FederatedTokenFile string // Path to a workload identity federation token, used instead of ClientSecret
+	ManagedIdentity    bool   // Authenticate as the managed identity of the host instead of a service principal
 }
@@ -0,0 +1,169 @@
+package microsoft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/sisatech/progress"
+)
+
+const (
+	diskAPIVersion = "2022-03-02"
+
+	// limits on the size of a managed disk created for upload, including the
+	// VHD footer
+	minUploadDiskSize = 20*1024*1024 + vhdFooterSize
+	maxUploadDiskSize = 32*1024*1024*1024*1024 + vhdFooterSize
+
+	// how long the write SAS of a managed disk remains valid
+	diskAccessDuration = 24 * 60 * 60
+)
+
+type diskCreationDataStruct struct {
+	CreateOption    string `json:"createOption"`
+	UploadSizeBytes int64  `json:"uploadSizeBytes"`
+}
+
+type diskPropertiesStruct struct {
+	CreationData diskCreationDataStruct `json:"creationData"`
+}
+
+type diskSkuStruct struct {
+	Name string `json:"name"`
+}
+
+type diskStruct struct {
+	Location   string               `json:"location"`
+	Tags       map[string]string    `json:"tags,omitempty"`
+	Sku        diskSkuStruct        `json:"sku"`
+	Properties diskPropertiesStruct `json:"properties"`
+}
+
+type diskAccessStruct struct {
+	Access            string `json:"access"`
+	DurationInSeconds int    `json:"durationInSeconds"`
+}
+
+type diskAccessResultStruct struct {
+	AccessSAS string `json:"accessSAS"`
+}
+
+func diskID(p *Provisioner, name string) string {
+	return "/subscriptions/" + p.cfg.SubID + "/resourceGroups/" + p.cfg.ResourceGroup + "/providers/Microsoft.Compute/disks/" + name
+}
+
+func diskURL(p *Provisioner, name string) string {
+	return "https://management.azure.com" + diskID(p, name)
+}
+
+// createUploadDisk creates an empty managed disk of size bytes that accepts
+// a direct upload.
+func createUploadDisk(p *Provisioner, name string, size int64, tags map[string]string) error {
+	diskData := &diskStruct{
+		Location: p.cfg.Location,
+		Tags:     tags,
+		Sku: diskSkuStruct{
+			Name: "Standard_LRS",
+		},
+		Properties: diskPropertiesStruct{
+			CreationData: diskCreationDataStruct{
+				CreateOption:    "Upload",
+				UploadSizeBytes: size,
+			},
+		},
+	}
+
+	_, err := armOperation(p, "PUT", diskURL(p, name)+"?api-version="+diskAPIVersion, diskData)
+	return err
+}
+
+// grantDiskWriteAccess returns a SAS URL that allows the disk to be written.
+func grantDiskWriteAccess(p *Provisioner, name string) (string, error) {
+	accessData := &diskAccessStruct{
+		Access:            "Write",
+		DurationInSeconds: diskAccessDuration,
+	}
+
+	bodyBytes, err := armOperation(p, "POST", diskURL(p, name)+"/beginGetAccess?api-version="+diskAPIVersion, accessData)
+	if err != nil {
+		return "", err
+	}
+
+	result := new(diskAccessResultStruct)
+	err = json.Unmarshal(bodyBytes, result)
+	if err != nil {
+		return "", err
+	}
+
+	if result.AccessSAS == "" {
+		return "", errors.New("no SAS returned for disk " + name)
+	}
+
+	return result.AccessSAS, nil
+}
+
+func revokeDiskAccess(p *Provisioner, name string) error {
+	_, err := armOperation(p, "POST", diskURL(p, name)+"/endGetAccess?api-version="+diskAPIVersion, nil)
+	return err
+}
+
+func deleteDisk(p *Provisioner, name string) error {
+	_, err := armOperation(p, "DELETE", diskURL(p, name)+"?api-version="+diskAPIVersion, nil)
+	return err
+}
+
+// uploadManagedDisk creates the managed disk name with tags and uploads src
+// into it through a temporary write SAS.
+func uploadManagedDisk(p *Provisioner, name string, src diskSource, tags map[string]string, pt progress.ProgressTracker) error {
+
+	max := src.maxSize()
+	if max < 0 {
+		return errors.New("the size of the image must be known to upload it to a managed disk")
+	}
+
+	size := roundUp(max, vhdAlignment) + vhdFooterSize
+	if size < minUploadDiskSize {
+		size = minUploadDiskSize
+	}
+	if size > maxUploadDiskSize {
+		return fmt.Errorf("image of %d bytes is too large for a managed disk", max)
+	}
+
+	err := createUploadDisk(p, name, size, tags)
+	if err != nil {
+		return err
+	}
+
+	sas, err := grantDiskWriteAccess(p, name)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(sas)
+	if err != nil {
+		return err
+	}
+
+	auth, err := newSASAuthorizer(u.RawQuery)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = ""
+
+	err = uploadPageBlob(&pageBlob{
+		url:  strings.TrimSuffix(u.String(), "?"),
+		auth: auth,
+		size: size,
+	}, src, p.cfg.UploadWorkers, pt)
+
+	// the disk cannot be used until its SAS has been revoked
+	rerr := revokeDiskAccess(p, name)
+	if err != nil {
+		return err
+	}
+
+	return rerr
+}
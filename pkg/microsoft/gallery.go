@@ -0,0 +1,340 @@
+package microsoft
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sisatech/progress"
+)
+
+const galleryAPIVersion = "2022-03-03"
+
+var semverRegexp = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// TargetRegion is a region an image version is replicated to.
+type TargetRegion struct {
+	Name               string // Azure region, e.g. "westeurope"
+	ReplicaCount       int    // Number of replicas in the region. Defaults to 1.
+	StorageAccountType string // "Standard_LRS", "Standard_ZRS" or "Premium_LRS". Defaults to the gallery's choice.
+}
+
+// GalleryImage describes where in an Azure Compute Gallery an image is
+// published. The gallery and image definition are created in the configured
+// resource group and location if they do not already exist.
+type GalleryImage struct {
+	Gallery          string         // Name of the gallery
+	Definition       string         // Name of the image definition within the gallery
+	Publisher        string         // Publisher of the image definition
+	Offer            string         // Offer of the image definition
+	SKU              string         // SKU of the image definition
+	OSType           string         // "Linux" or "Windows". Defaults to "Linux".
+	HyperVGeneration string         // "V1" or "V2". Defaults to "V1".
+	Version          string         // Image version to create, in the form Major.Minor.Patch
+	TargetRegions    []TargetRegion // Regions to replicate to. The configured location is always included.
+}
+
+type galleryPropertiesStruct struct {
+	Description string `json:"description,omitempty"`
+}
+
+type galleryStruct struct {
+	Location   string                  `json:"location"`
+	Properties galleryPropertiesStruct `json:"properties"`
+}
+
+type galleryImageIdentifierStruct struct {
+	Publisher string `json:"publisher"`
+	Offer     string `json:"offer"`
+	SKU       string `json:"sku"`
+}
+
+type galleryImagePropertiesStruct struct {
+	OsType           string                       `json:"osType"`
+	OsState          string                       `json:"osState"`
+	HyperVGeneration string                       `json:"hyperVGeneration"`
+	Identifier       galleryImageIdentifierStruct `json:"identifier"`
+}
+
+type galleryImageStruct struct {
+	Location   string                       `json:"location"`
+	Properties galleryImagePropertiesStruct `json:"properties"`
+}
+
+type targetRegionStruct struct {
+	Name                 string `json:"name"`
+	RegionalReplicaCount int    `json:"regionalReplicaCount"`
+	StorageAccountType   string `json:"storageAccountType,omitempty"`
+}
+
+type galleryImageVersionSourceStruct struct {
+	ID string `json:"id"`
+}
+
+type galleryImageVersionStorageProfileStruct struct {
+	Source galleryImageVersionSourceStruct `json:"source"`
+}
+
+type galleryImageVersionPublishingProfileStruct struct {
+	TargetRegions []targetRegionStruct `json:"targetRegions"`
+}
+
+type galleryImageVersionPropertiesStruct struct {
+	PublishingProfile galleryImageVersionPublishingProfileStruct `json:"publishingProfile"`
+	StorageProfile    galleryImageVersionStorageProfileStruct    `json:"storageProfile"`
+}
+
+type galleryImageVersionStruct struct {
+	Location   string                              `json:"location"`
+	Properties galleryImageVersionPropertiesStruct `json:"properties"`
+}
+
+type regionalReplicationStatusStruct struct {
+	Region   string `json:"region"`
+	State    string `json:"state"`
+	Details  string `json:"details"`
+	Progress int    `json:"progress"`
+}
+
+type galleryImageVersionStatusStruct struct {
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+		ReplicationStatus struct {
+			AggregatedState string                            `json:"aggregatedState"`
+			Summary         []regionalReplicationStatusStruct `json:"summary"`
+		} `json:"replicationStatus"`
+	} `json:"properties"`
+}
+
+func galleryURL(p *Provisioner, g *GalleryImage) string {
+	return "https://management.azure.com/subscriptions/" + p.cfg.SubID + "/resourceGroups/" + p.cfg.ResourceGroup + "/providers/Microsoft.Compute/galleries/" + g.Gallery
+}
+
+func galleryImageURL(p *Provisioner, g *GalleryImage) string {
+	return galleryURL(p, g) + "/images/" + g.Definition
+}
+
+func galleryImageVersionURL(p *Provisioner, g *GalleryImage) string {
+	return galleryImageURL(p, g) + "/versions/" + g.Version
+}
+
+func validateGalleryImage(g *GalleryImage) error {
+	if g.Gallery == "" || g.Definition == "" {
+		return fmt.Errorf("gallery and image definition names are required")
+	}
+	if g.Publisher == "" || g.Offer == "" || g.SKU == "" {
+		return fmt.Errorf("publisher, offer and SKU are required")
+	}
+	if !semverRegexp.MatchString(g.Version) {
+		return fmt.Errorf("image version '%s' is not of the form Major.Minor.Patch", g.Version)
+	}
+	return nil
+}
+
+// resourceExists reports whether a GET of url succeeds.
+func resourceExists(p *Provisioner, url string) (bool, error) {
+	_, _, err := armRequest(p, "GET", url, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func createGallery(p *Provisioner, g *GalleryImage) error {
+	exists, err := resourceExists(p, galleryURL(p, g)+"?api-version="+galleryAPIVersion)
+	if err != nil || exists {
+		return err
+	}
+
+	galleryData := &galleryStruct{
+		Location: p.cfg.Location,
+	}
+
+	_, err = armOperation(p, "PUT", galleryURL(p, g)+"?api-version="+galleryAPIVersion, galleryData)
+	return err
+}
+
+func createGalleryImageDefinition(p *Provisioner, g *GalleryImage) error {
+	exists, err := resourceExists(p, galleryImageURL(p, g)+"?api-version="+galleryAPIVersion)
+	if err != nil || exists {
+		return err
+	}
+
+	galleryImageData := &galleryImageStruct{
+		Location: p.cfg.Location,
+		Properties: galleryImagePropertiesStruct{
+			OsType:           g.OSType,
+			OsState:          "Generalized",
+			HyperVGeneration: g.HyperVGeneration,
+			Identifier: galleryImageIdentifierStruct{
+				Publisher: g.Publisher,
+				Offer:     g.Offer,
+				SKU:       g.SKU,
+			},
+		},
+	}
+
+	_, err = armOperation(p, "PUT", galleryImageURL(p, g)+"?api-version="+galleryAPIVersion, galleryImageData)
+	return err
+}
+
+func checkGalleryImageVersionExists(p *Provisioner, g *GalleryImage, overwrite bool) error {
+	url := galleryImageVersionURL(p, g) + "?api-version=" + galleryAPIVersion
+
+	exists, err := resourceExists(p, url)
+	if err != nil || !exists {
+		return err
+	}
+
+	if !overwrite {
+		return fmt.Errorf("Image version '%s' of '%s' already exists", g.Version, g.Definition)
+	}
+
+	_, err = armOperation(p, "DELETE", url, nil)
+	return err
+}
+
+// targetRegions returns the regions of g with defaults applied and the
+// configured location added if it is missing.
+func targetRegions(p *Provisioner, g *GalleryImage) []targetRegionStruct {
+	var regions []targetRegionStruct
+	hasSource := false
+	for _, r := range g.TargetRegions {
+		count := r.ReplicaCount
+		if count <= 0 {
+			count = 1
+		}
+		if strings.EqualFold(r.Name, p.cfg.Location) {
+			hasSource = true
+		}
+		regions = append(regions, targetRegionStruct{
+			Name:                 r.Name,
+			RegionalReplicaCount: count,
+			StorageAccountType:   r.StorageAccountType,
+		})
+	}
+
+	if !hasSource {
+		regions = append(regions, targetRegionStruct{
+			Name:                 p.cfg.Location,
+			RegionalReplicaCount: 1,
+		})
+	}
+
+	return regions
+}
+
+// reportReplication reports the replication progress of each region of an
+// image version to its own subtracker of pt, kept in regions.
+func reportReplication(p *Provisioner, g *GalleryImage, regions map[string]progress.ProgressTracker, pt progress.ProgressTracker) error {
+	_, bodyBytes, err := armRequest(p, "GET", galleryImageVersionURL(p, g)+"?$expand=ReplicationStatus&api-version="+galleryAPIVersion, nil)
+	if err != nil {
+		return err
+	}
+
+	status := new(galleryImageVersionStatusStruct)
+	err = json.Unmarshal(bodyBytes, status)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range status.Properties.ReplicationStatus.Summary {
+		rt, ok := regions[r.Region]
+		if !ok {
+			rt = pt.NewWeightedSubtracker(1)
+			rt.Initialize("Replicating to "+r.Region+".", 100, progress.UnitPercent)
+			regions[r.Region] = rt
+		}
+		stage := r.State
+		if r.Details != "" {
+			stage += ": " + r.Details
+		}
+		rt.SetStage(stage)
+		rt.SetProgress(float64(r.Progress))
+	}
+
+	return nil
+}
+
+// createGalleryImageVersion creates an image version from the managed image
+// imageName and waits for it to be replicated, reporting each region's
+// progress to its own subtracker of pt.
+func createGalleryImageVersion(p *Provisioner, g *GalleryImage, imageName string, pt progress.ProgressTracker) error {
+	versionData := &galleryImageVersionStruct{
+		Location: p.cfg.Location,
+		Properties: galleryImageVersionPropertiesStruct{
+			PublishingProfile: galleryImageVersionPublishingProfileStruct{
+				TargetRegions: targetRegions(p, g),
+			},
+			StorageProfile: galleryImageVersionStorageProfileStruct{
+				Source: galleryImageVersionSourceStruct{
+					ID: "/subscriptions/" + p.cfg.SubID + "/resourceGroups/" + p.cfg.ResourceGroup + "/providers/Microsoft.Compute/images/" + imageName,
+				},
+			},
+		},
+	}
+
+	regions := make(map[string]progress.ProgressTracker)
+	_, err := armOperationWithPoll(p, "PUT", galleryImageVersionURL(p, g)+"?api-version="+galleryAPIVersion, versionData, func() error {
+		return reportReplication(p, g, regions, pt)
+	})
+
+	// the final state of each region is reported even if replication failed,
+	// so that the failing region can be seen
+	rerr := reportReplication(p, g, regions, pt)
+	if err == nil {
+		err = rerr
+	}
+	for _, rt := range regions {
+		rt.Close(err)
+	}
+
+	return err
+}
+
+// PublishToGallery publishes the managed image imageName as a new version of
+// a gallery image definition, replicating it to every target region. The
+// replication progress of each region is reported to a subtracker of pt.
+func (p *Provisioner) PublishToGallery(imageName string, g *GalleryImage, overwriteVersion bool, pt progress.ProgressTracker) error {
+
+	err := validateGalleryImage(g)
+	if err != nil {
+		return err
+	}
+
+	gi := *g
+	if gi.OSType == "" {
+		gi.OSType = "Linux"
+	}
+	if gi.HyperVGeneration == "" {
+		gi.HyperVGeneration = "V1"
+	}
+
+	pt.Initialize("Publishing image to gallery.", 0, progress.UnitStep)
+
+	pt.SetStage("Creating gallery.")
+	err = createGallery(p, &gi)
+	if err != nil {
+		return err
+	}
+
+	pt.SetStage("Creating image definition.")
+	err = createGalleryImageDefinition(p, &gi)
+	if err != nil {
+		return err
+	}
+
+	pt.SetStage("Checking if image version already exists.")
+	err = checkGalleryImageVersionExists(p, &gi, overwriteVersion)
+	if err != nil {
+		return err
+	}
+
+	pt.SetStage("Creating and replicating image version.")
+	return createGalleryImageVersion(p, &gi, imageName, pt)
+}
@@ -5,21 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
-	"time"
 
-	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sisatech/progress"
 )
 
-type resourceGroupTagsStruct struct {
-	Tagname1 string `json:"tagname1"`
-}
-
 type resourceGroupStruct struct {
-	Location string                  `json:"location"`
-	Tags     resourceGroupTagsStruct `json:"tags"`
+	Location string            `json:"location"`
+	Tags     map[string]string `json:"tags,omitempty"`
 }
 
 type virtualNetworkAddressSpaceStruct struct {
@@ -82,26 +78,47 @@ type networkInterfaceStruct struct {
 	Properties networkPropertiesStruct `json:"properties"`
 }
 
+type imageManagedDiskStruct struct {
+	ID string `json:"id"`
+}
+
 type imageOSDiskStruct struct {
-	OsType  string `json:"osType"`
-	BlobURI string `json:"blobUri"`
-	OsState string `json:"osState"`
+	OsType      string                  `json:"osType"`
+	BlobURI     string                  `json:"blobUri,omitempty"`
+	ManagedDisk *imageManagedDiskStruct `json:"managedDisk,omitempty"`
+	OsState     string                  `json:"osState"`
+}
+
+type imageDataDiskStruct struct {
+	Lun                int                     `json:"lun"`
+	BlobURI            string                  `json:"blobUri,omitempty"`
+	ManagedDisk        *imageManagedDiskStruct `json:"managedDisk,omitempty"`
+	Caching            string                  `json:"caching,omitempty"`
+	StorageAccountType string                  `json:"storageAccountType,omitempty"`
 }
 
 type imageStorageProfileStruct struct {
-	OsDisk imageOSDiskStruct `json:"osDisk"`
+	OsDisk        imageOSDiskStruct     `json:"osDisk"`
+	DataDisks     []imageDataDiskStruct `json:"dataDisks,omitempty"`
+	ZoneResilient bool                  `json:"zoneResilient"`
 }
 
 type imagePropertiesStruct struct {
-	StorageProfile imageStorageProfileStruct `json:"storageProfile"`
+	StorageProfile   imageStorageProfileStruct `json:"storageProfile"`
+	HyperVGeneration string                    `json:"hyperVGeneration"`
 }
 
 type imageStruct struct {
 	Location   string                `json:"location"`
+	Tags       map[string]string     `json:"tags,omitempty"`
 	Properties imagePropertiesStruct `json:"properties"`
 }
 
-func sendRestRequest(authCookie string, verb string, url string, data interface{}) (*http.Response, error) {
+const imageAPIVersion = "2022-03-01"
+
+var metadataNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func sendRestRequest(p *Provisioner, verb string, url string, data interface{}) (*http.Response, error) {
 
 	var b bytes.Reader
 	body := &b
@@ -113,13 +130,18 @@ func sendRestRequest(authCookie string, verb string, url string, data interface{
 		body = bytes.NewReader(structBytes)
 	}
 
+	token, err := p.auth.Token()
+	if err != nil {
+		return nil, err
+	}
+
 	req, err := http.NewRequest(verb, url, body)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Host", "management.azure.com")
-	req.Header.Set("Authorization", "Bearer "+authCookie)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
@@ -130,32 +152,19 @@ func sendRestRequest(authCookie string, verb string, url string, data interface{
 	return resp, nil
 }
 
-func createResourceGroup(p *Provisioner, authCookie string) error {
+func createResourceGroup(p *Provisioner, tags map[string]string) error {
 	// Create Resource Group
-	resourceGroupTagsData := resourceGroupTagsStruct{
-		Tagname1: "test-tag",
-	}
-
 	resourceGroupData := &resourceGroupStruct{
 		Location: p.cfg.Location,
-		Tags:     resourceGroupTagsData,
+		Tags:     tags,
 	}
 
 	// fmt.Println("Creating Resource Group...")
-	resp, err := sendRestRequest(authCookie, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"?api-version=2017-08-01", resourceGroupData)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
-	}
-
-	return nil
+	_, err := armOperation(p, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"?api-version=2017-08-01", resourceGroupData)
+	return err
 }
 
-func createVirtualNetwork(p *Provisioner, authCookie string, virtualNetworkName string) error {
+func createVirtualNetwork(p *Provisioner, virtualNetworkName string) error {
 	// Create Virtual Network
 	virtualNetworkAddressSpaceData := virtualNetworkAddressSpaceStruct{
 		AddressPrefixes: []string{"10.0.0.0/16"},
@@ -182,20 +191,11 @@ func createVirtualNetwork(p *Provisioner, authCookie string, virtualNetworkName
 	}
 
 	// fmt.Println("Creating Virtual Network...")
-	resp, err := sendRestRequest(authCookie, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Network/virtualNetworks/"+virtualNetworkName+"?api-version=2017-10-01", virtualNetworkStructData)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
-	}
-
-	return nil
+	_, err := armOperation(p, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Network/virtualNetworks/"+virtualNetworkName+"?api-version=2017-10-01", virtualNetworkStructData)
+	return err
 }
 
-func createPublicIPAddresses(p *Provisioner, authCookie string, ipName string) error {
+func createPublicIPAddresses(p *Provisioner, ipName string) error {
 	// Create Public IP Address
 	publicIPAddressData := &publicIPAddressStruct{
 		Name:     ipName,
@@ -203,20 +203,11 @@ func createPublicIPAddresses(p *Provisioner, authCookie string, ipName string) e
 	}
 
 	// fmt.Println("Creating Public IP Address...")
-	resp, err := sendRestRequest(authCookie, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Network/publicIPAddresses/"+ipName+"?api-version=2017-10-01", publicIPAddressData)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
-	}
-
-	return nil
+	_, err := armOperation(p, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Network/publicIPAddresses/"+ipName+"?api-version=2017-10-01", publicIPAddressData)
+	return err
 }
 
-func createNetworkInterfaces(p *Provisioner, authCookie string, networkName string, ipName string, virtualNetworkName string, ipConfigName string) error {
+func createNetworkInterfaces(p *Provisioner, networkName string, ipName string, virtualNetworkName string, ipConfigName string) error {
 	// Create Network interface
 	publicIPAddressConfigurationsData := publicIPAddressConfigurationsStruct{
 		ID: "/subscriptions/" + p.cfg.SubID + "/resourceGroups/" + p.cfg.ResourceGroup + "/providers/Microsoft.Network/publicIPAddresses/" + ipName,
@@ -249,215 +240,311 @@ func createNetworkInterfaces(p *Provisioner, authCookie string, networkName stri
 	}
 
 	// fmt.Println("Creating Network Interface...")
-	resp, err := sendRestRequest(authCookie, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Network/networkInterfaces/"+networkName+"?api-version=2017-11-01", networkInterfacesData)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	_, err := armOperation(p, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Network/networkInterfaces/"+networkName+"?api-version=2017-11-01", networkInterfacesData)
+	return err
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
-	}
+func imageURL(p *Provisioner, imageName string) string {
+	return "https://management.azure.com/subscriptions/" + p.cfg.SubID + "/resourceGroups/" + p.cfg.ResourceGroup + "/providers/Microsoft.Compute/images/" + imageName + "?api-version=" + imageAPIVersion
+}
 
-	return nil
+// dataDiskName returns the name of the blob or managed disk a data disk of
+// the image is uploaded to.
+func dataDiskName(imageName string, lun int) string {
+	return imageName + "-lun" + strconv.Itoa(lun)
 }
 
-func createImage(p *Provisioner, authCookie string, imageName string, blobURI string) error {
+// imageDisk returns the blob URI or managed disk of the uploaded disk name.
+func imageDisk(p *Provisioner, name string) (string, *imageManagedDiskStruct) {
+	if p.cfg.DirectUpload {
+		return "", &imageManagedDiskStruct{
+			ID: diskID(p, name),
+		}
+	}
+	return blobURL(p.cfg, p.cfg.Container, name+".vhd"), nil
+}
+
+func createImage(p *Provisioner, imageName string, opts *PrepareOptions) error {
 	// Create Image
 	imageOSDiskData := imageOSDiskStruct{
-		OsType:  "Linux",
-		BlobURI: blobURI,
+		OsType:  opts.OSType,
 		OsState: "generalized",
 	}
+	imageOSDiskData.BlobURI, imageOSDiskData.ManagedDisk = imageDisk(p, imageName)
+
+	var dataDisks []imageDataDiskStruct
+	for _, d := range opts.DataDisks {
+		dataDisk := imageDataDiskStruct{
+			Lun:                d.Lun,
+			Caching:            d.Caching,
+			StorageAccountType: d.StorageAccountType,
+		}
+		dataDisk.BlobURI, dataDisk.ManagedDisk = imageDisk(p, dataDiskName(imageName, d.Lun))
+		dataDisks = append(dataDisks, dataDisk)
+	}
 
 	imageStorageProfileData := imageStorageProfileStruct{
-		OsDisk: imageOSDiskData,
+		OsDisk:        imageOSDiskData,
+		DataDisks:     dataDisks,
+		ZoneResilient: opts.ZoneResilient,
 	}
 
 	imagePropertiesData := imagePropertiesStruct{
-		StorageProfile: imageStorageProfileData,
+		StorageProfile:   imageStorageProfileData,
+		HyperVGeneration: opts.HyperVGeneration,
 	}
 
 	imageData := &imageStruct{
 		Location:   p.cfg.Location,
+		Tags:       opts.Tags,
 		Properties: imagePropertiesData,
 	}
 
 	// fmt.Println("Creating VM Image...")
-	resp, err := sendRestRequest(authCookie, "PUT", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Compute/images/"+imageName+"?api-version=2017-12-01", imageData)
+	_, err := armOperation(p, "PUT", imageURL(p, imageName), imageData)
+	return err
+}
+
+// deleteUploadedDisk removes the blob or managed disk name once the image
+// has been created from it.
+func deleteUploadedDisk(p *Provisioner, name string) error {
+	if p.cfg.DirectUpload {
+		return deleteDisk(p, name)
+	}
+	return deleteVHD(p, name)
+}
+
+func deleteVHD(p *Provisioner, name string) error {
+	resp, err := blobRequest(p.blobAuth, "DELETE", blobURL(p.cfg, p.cfg.Container, name+".vhd"), nil, nil, 0)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
 		return fmt.Errorf("bad status code %d", resp.StatusCode)
 	}
-
 	return nil
 }
 
-func waitUntilImageCreated(p *Provisioner, authCookie string, imageName string) error {
-	for {
-		resp, err := sendRestRequest(authCookie, "GET", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Compute/images/"+imageName+"?api-version=2017-12-01", nil)
-
-		// fmt.Println("Checking if Image has been created...")
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		j := make(map[string]interface{})
-		json.Unmarshal(bodyBytes, &j)
-
-		status := j["properties"].(map[string]interface{})["provisioningState"].(string)
-
-		if resp.StatusCode < 200 || resp.StatusCode > 202 {
-			return fmt.Errorf("bad status code %d", resp.StatusCode)
-		}
-
-		if status == "Succeeded" {
-			break
-		}
-		time.Sleep(15 * time.Second)
+func checkImageExists(p *Provisioner, imageName string, overwrite bool) error {
+	_, _, err := armRequest(p, "GET", imageURL(p, imageName), nil)
+	if isNotFound(err) {
+		return nil
 	}
-
-	return nil
-}
-
-func authorise(p *Provisioner) (string, error) {
-	// Authorisation
-	// fmt.Println("Authorising...")
-	appID := "39d15fa2-78db-4e29-a49e-e2ea61f88167"
-
-	authBody := strings.NewReader(`grant_type=client_credentials&client_id=` + appID + `&client_secret=` + p.password + `&resource=https%3A%2F%2Fmanagement.azure.com%2F`)
-
-	req, err := http.NewRequest("POST", "https://login.microsoftonline.com/13d2599e-aa13-4ccf-9a61-737690c21451/oauth2/token", authBody)
 	if err != nil {
-		return "", err
+		return err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+	if !overwrite {
+		return fmt.Errorf("Image '%s' already exists", imageName)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return "", err
-	}
+	return deleteImage(p, imageName)
+}
 
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	j := make(map[string]interface{})
-	json.Unmarshal(bodyBytes, &j)
+func deleteImage(p *Provisioner, imageName string) error {
+	_, err := armOperation(p, "DELETE", imageURL(p, imageName), nil)
+	return err
+}
 
-	return j["access_token"].(string), nil
+// DataDisk is an additional disk captured in the image.
+type DataDisk struct {
+	Lun                int       // Logical unit number of the disk, unique within the image
+	Source             io.Reader // Disk image, in any format accepted by Provision
+	Caching            string    // "None", "ReadOnly" or "ReadWrite". Defaults to Azure's choice.
+	StorageAccountType string    // "Standard_LRS", "Premium_LRS", etc. Defaults to Azure's choice.
 }
 
-func deleteVHD(p *Provisioner, name string) error {
-	err := p.blob.Delete(&storage.DeleteBlobOptions{})
-	if err != nil {
-		return err
-	}
-	return nil
+// PrepareOptions holds optional settings for Prepare.
+type PrepareOptions struct {
+	OSType           string            // "Linux" or "Windows". Defaults to "Linux".
+	HyperVGeneration string            // "V1" or "V2". Defaults to "V1".
+	ZoneResilient    bool              // Store the image in zone-redundant storage where the region supports it
+	DataDisks        []DataDisk        // Data disks uploaded alongside the OS disk and captured in the image
+	Tags             map[string]string // Tags applied to the resource group and image, and to the uploaded blobs as metadata
+	Gallery          *GalleryImage     // If set, the image is also published as a version of this gallery image
 }
 
-func checkImageExists(p *Provisioner, authCookie string, imageName string, overwrite bool) error {
-	resp, err := sendRestRequest(authCookie, "GET", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Compute/images/?api-version=2016-04-30-preview", nil)
-	if err != nil {
-		return err
+// validatePrepareOptions checks opts and fills in its defaults.
+func validatePrepareOptions(p *Provisioner, opts *PrepareOptions) error {
+	switch opts.OSType {
+	case "":
+		opts.OSType = "Linux"
+	case "Linux", "Windows":
+	default:
+		return fmt.Errorf("unsupported OS type '%s'", opts.OSType)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	switch opts.HyperVGeneration {
+	case "":
+		opts.HyperVGeneration = "V1"
+	case "V1", "V2":
+	default:
+		return fmt.Errorf("unsupported Hyper-V generation '%s'", opts.HyperVGeneration)
 	}
 
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	j := make(map[string]interface{})
-	json.Unmarshal(bodyBytes, &j)
+	luns := make(map[int]bool)
+	for _, d := range opts.DataDisks {
+		if d.Lun < 0 || d.Lun > 63 {
+			return fmt.Errorf("data disk LUN %d is out of range", d.Lun)
+		}
+		if luns[d.Lun] {
+			return fmt.Errorf("data disk LUN %d is used more than once", d.Lun)
+		}
+		luns[d.Lun] = true
+		if d.Source == nil {
+			return fmt.Errorf("data disk %d has no source", d.Lun)
+		}
+	}
 
-	for i := 0; i < len(j["value"].([]interface{})); i++ {
-		if j["value"].([]interface{})[i].(map[string]interface{})["name"] == imageName {
-			if overwrite {
-				deleteImage(p, authCookie, imageName)
-			} else {
-				return fmt.Errorf("Image '%s' already exists", imageName)
-			}
+	for k, v := range opts.Tags {
+		if k == "" || len(k) > 512 || strings.ContainsAny(k, "<>%&\\?/") {
+			return fmt.Errorf("invalid tag name '%s'", k)
+		}
+		if len(v) > 256 {
+			return fmt.Errorf("value of tag '%s' is longer than 256 characters", k)
+		}
+		// tags become blob metadata, whose names must be C# identifiers
+		if !p.cfg.DirectUpload && !metadataNameRegexp.MatchString(k) {
+			return fmt.Errorf("tag name '%s' cannot be used as blob metadata", k)
 		}
 	}
 
+	if opts.Gallery != nil {
+		err := validateGalleryImage(opts.Gallery)
+		if err != nil {
+			return err
+		}
+
+		// the image definition describes the image unless told otherwise
+		g := *opts.Gallery
+		if g.OSType == "" {
+			g.OSType = opts.OSType
+		}
+		if g.HyperVGeneration == "" {
+			g.HyperVGeneration = opts.HyperVGeneration
+		}
+		opts.Gallery = &g
+	}
+
 	return nil
 }
 
-func deleteImage(p *Provisioner, authCookie string, imageName string) error {
+// Prepare uploads r, creates the managed image name from it and, if
+// requested, publishes the image to a gallery, reporting each stage to pt.
+// The uploaded disks are deleted once Prepare finishes, whether or not it
+// succeeds.
+func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool, opts *PrepareOptions, pt progress.ProgressTracker) (err error) {
 
-	resp, err := sendRestRequest(authCookie, "DELETE", "https://management.azure.com/subscriptions/"+p.cfg.SubID+"/resourceGroups/"+p.cfg.ResourceGroup+"/providers/Microsoft.Compute/images/"+imageName+"?api-version=2016-04-30-preview", nil)
-	if err != nil {
-		return err
+	o := new(PrepareOptions)
+	if opts != nil {
+		*o = *opts
 	}
-	defer resp.Body.Close()
+	opts = o
 
-	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	// the disks share the upload's weight equally, as their sizes may not
+	// be known
+	diskWeight := 60 / float64(len(opts.DataDisks)+1)
+	weights := []progress.StageWeight{
+		{Name: "Checking options.", Weight: 5},
+		{Name: "Uploading OS disk.", Weight: diskWeight},
 	}
+	for _, d := range opts.DataDisks {
+		weights = append(weights, progress.StageWeight{Name: fmt.Sprintf("Uploading data disk %d.", d.Lun), Weight: diskWeight})
+	}
+	weights = append(weights, progress.StageWeight{Name: "Creating image.", Weight: 5})
+	if opts.Gallery != nil {
+		weights = append(weights, progress.StageWeight{Name: "Publishing image to gallery.", Weight: 30})
+	}
+	stages := progress.NewWeightedStages(pt, "Provisioning Virtual Machine Image.", weights...)
+	defer func() { stages.Close(err) }()
 
-	return nil
-}
-
-// Prepare ...
-func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool) error {
+	st := stages.Next()
+	st.Initialize("Checking options.", 3, progress.UnitStep)
 
-	authCookie, err := authorise(p)
+	st.SetStage("Validating options.")
+	err = validatePrepareOptions(p, opts)
 	if err != nil {
 		return err
 	}
+	st.IncrementProgress(1)
 
-	err = checkImageExists(p, authCookie, name, overwriteImage)
+	st.SetStage("Checking if image already exists.")
+	err = checkImageExists(p, name, overwriteImage)
 	if err != nil {
 		return err
 	}
+	st.IncrementProgress(1)
 
-	err = p.Provision(name, r)
+	// a managed disk is created in the resource group, so it must exist
+	// before uploading
+	st.SetStage("Creating resource group.")
+	err = createResourceGroup(p, opts.Tags)
 	if err != nil {
 		return err
 	}
+	st.IncrementProgress(1)
+
+	// the image keeps its own copy of the uploaded disks, so they are
+	// deleted once Prepare finishes
+	var cleanup []func() error
+	defer func() {
+		if len(cleanup) == 0 {
+			return
+		}
+		pt.SetStage("Deleting temporary disks.")
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cerr := cleanup[i]()
+			if err == nil {
+				err = cerr
+			}
+		}
+	}()
 
-	err = createResourceGroup(p, authCookie)
+	cleanup = append(cleanup, func() error { return deleteUploadedDisk(p, name) })
+	err = provision(p, name, r, opts.Tags, stages.Next())
 	if err != nil {
 		return err
 	}
 
-	// err = createVirtualNetwork(p, authCookie, name+"VirtualNetwork")
+	for _, d := range opts.DataDisks {
+		diskName := dataDiskName(name, d.Lun)
+		cleanup = append(cleanup, func() error { return deleteUploadedDisk(p, diskName) })
+		err = provision(p, diskName, d.Source, opts.Tags, stages.Next())
+		if err != nil {
+			return err
+		}
+	}
+
+	// err = createVirtualNetwork(p, name+"VirtualNetwork")
 	// if err != nil {
 	// 	return err
 	// }
 
-	// err = createPublicIPAddresses(p, authCookie, name+"-ip")
+	// err = createPublicIPAddresses(p, name+"-ip")
 	// if err != nil {
 	// 	return err
 	// }
 
-	// err = createNetworkInterfaces(p, authCookie, name+"-nic", name+"-ip", name+"VirtualNetwork", name+"IPConfig")
+	// err = createNetworkInterfaces(p, name+"-nic", name+"-ip", name+"VirtualNetwork", name+"IPConfig")
 	// if err != nil {
 	// 	return err
 	// }
 
-	err = createImage(p, authCookie, name, "https://"+p.cfg.StorageAccount+".blob.core.windows.net/"+p.cfg.Container+"/"+name+".vhd")
+	it := stages.Next()
+	it.Initialize("Creating image.", 1, progress.UnitStep)
+	err = createImage(p, name, opts)
 	if err != nil {
 		return err
 	}
+	it.IncrementProgress(1)
 
-	err = waitUntilImageCreated(p, authCookie, name)
-	if err != nil {
-		return err
-	}
-
-	deleteVHD(p, name)
-	if err != nil {
-		return err
+	if opts.Gallery != nil {
+		err = p.PublishToGallery(name, opts.Gallery, overwriteImage, stages.Next())
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
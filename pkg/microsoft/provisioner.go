@@ -1,70 +1,34 @@
 package microsoft
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"time"
 
-	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
 )
 
 // Provisioner ...
 type Provisioner struct {
-	cfg      *Config            // Config of the provisioner
-	blob     *storage.Blob      // The blob that is uploaded
-	cnt      *storage.Container // container to upload the vhd into
-	password string             // Users password
+	cfg      *Config        // Config of the provisioner
+	auth     *tokenSource   // Azure AD access tokens for Resource Manager
+	blobAuth blobAuthorizer // authorises requests to the Blob service
 }
 
-// Creates a sha256 hash of the string msg, with the key secretKey
-func signSha256(secretKey string, msg string) string {
-	dec, _ := base64.StdEncoding.DecodeString(secretKey)
-	key := []byte(dec)
-	h := hmac.New(sha256.New, key)
-	h.Write([]byte(msg))
-	return base64.StdEncoding.EncodeToString(h.Sum(nil))
-}
-
-// Creates a container within a blob
-func createContainer(cfg *Config) error {
-	// Create signature
-	url := "https://" + cfg.StorageAccount + ".blob.core.windows.net/" + cfg.Container + "?restype=container"
-	version := "2016-05-31"
-	date := time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
-	parameters := "\nrestype:container"
-
-	canonicalizedHeaders := "x-ms-date:" + date + "\nx-ms-version:" + version
-	canonicalizedResources := "/" + cfg.StorageAccount + "/" + cfg.Container + parameters
-
-	verb := "PUT"
-	stringToSign := verb + "\n\n\n\n\n\n\n\n\n\n\n\n" + canonicalizedHeaders + "\n" + canonicalizedResources
-
-	signature := signSha256(cfg.StorageKey, stringToSign)
-
-	// Create Container
-	req, err := http.NewRequest(verb, url, nil)
+// createContainer creates the configured container, succeeding if it already
+// exists.
+func createContainer(p *Provisioner) error {
+	resp, err := blobRequest(p.blobAuth, "PUT", blobURL(p.cfg, p.cfg.Container, "")+"?restype=container", nil, nil, 0)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	req.Header.Set("x-ms-date", date)
-	req.Header.Set("x-ms-version", version)
-	req.Header.Set("Authorization", "SharedKey mystorageaccountsisatech:"+signature)
-
-	// send the request
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	if resp.StatusCode == http.StatusConflict && resp.Header.Get("x-ms-error-code") == "ContainerAlreadyExists" {
+		return nil
 	}
 
-	defer resp.Body.Close()
-
 	if resp.StatusCode < 200 || resp.StatusCode > 201 {
 		return fmt.Errorf("bad status code %d", resp.StatusCode)
 	}
@@ -77,84 +41,76 @@ func NewProvisioner(cfg *Config) (*Provisioner, error) {
 	p := new(Provisioner)
 	p.cfg = cfg
 
-	client, err := storage.NewBasicClient(cfg.StorageAccount, cfg.StorageKey)
+	var err error
+	p.auth, err = newTokenSource(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	blobCli := client.GetBlobService()
+	// uploading straight to a managed disk needs no storage account
+	if cfg.DirectUpload {
+		return p, nil
+	}
 
-	// attempts to create a container
-	err = createContainer(cfg)
-	if err != nil && err.Error() != "bad status code 409" {
+	p.blobAuth, err = newBlobAuthorizer(cfg)
+	if err != nil {
 		return nil, err
 	}
-	cnt := blobCli.GetContainerReference(cfg.Container)
 
-	p.cnt = cnt
+	// attempts to create a container
+	err = createContainer(p)
+	if err != nil {
+		return nil, err
+	}
 
 	return p, nil
 }
 
 // Provision ...
 func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
+	return p.ProvisionWithProgress(f, r, progress.NewProgressTracker())
+}
 
-	name := f
-	if len(f) < 5 || string(f[len(f)-4:]) != ".vhd" {
-		name = f + ".vhd"
-	}
+// ProvisionWithProgress uploads r as the page blob f, appending ".vhd" to the
+// name if it is missing, and reports the bytes uploaded to pt. The image in r
+// may be a raw disk, a fixed VHD or a dynamic VHD; it is converted to a fixed
+// VHD sized to a whole MiB as Azure requires. If Config.DirectUpload is set,
+// r is uploaded into a new managed disk called f instead, and its size must
+// be known in advance.
+func (p *Provisioner) ProvisionWithProgress(f string, r io.ReadCloser, pt progress.ProgressTracker) error {
+	return provision(p, f, r, nil, pt)
+}
 
-	blob := p.cnt.GetBlobReference(name)
-	p.blob = blob
+// provision uploads r as ProvisionWithProgress does, applying tags to the
+// managed disk or, as metadata, to the page blob.
+func provision(p *Provisioner, f string, r io.Reader, tags map[string]string, pt progress.ProgressTracker) error {
 
-	rBytes, err := ioutil.ReadAll(r)
+	size := upload.SourceSize(r)
+	src, err := openDisk(r, size)
 	if err != nil {
 		return err
 	}
-	length := len(rBytes)
 
-	// blob properties - length must be a multiple of 512 bytes
-	contentLength := int64(length)
-	remainder := int64(length) % 512
-	if remainder > 0 {
-		contentLength += 512 - remainder
+	if size < 0 {
+		size = 0
 	}
+	pt.Initialize("Uploading VHD.", float64(size), progress.UnitBytes)
 
-	blob.Properties.ContentType = "text/plain"
-	blob.Properties.ContentLength = contentLength
-
-	// creates blob
-	err = blob.PutPageBlob(nil)
-	if err != nil {
-		return err
+	if p.cfg.DirectUpload {
+		pt.SetStage("Uploading managed disk " + f + ".")
+		return uploadManagedDisk(p, f, src, tags, pt)
 	}
 
-	// writes data to blob - must be less than or equal to 4Mb and a multiple of 512 bytes
-	i := 0
-	for i = 0; i < (length - 4194304); i += 4194304 {
-		data := make([]byte, 4194304)
-		copy(data[:], rBytes[i:i+4194304])
-		br := storage.BlobRange{
-			Start: uint64(i),
-			End:   uint64(i + 4194304 - 1),
-		}
-
-		err = blob.WriteRange(br, bytes.NewReader(data), nil)
-		if err != nil {
-			return err
-		}
-	}
-	rem := length - i
-	data := make([]byte, rem)
-	copy(data[:], rBytes[i:length])
-	br := storage.BlobRange{
-		Start: uint64(i),
-		End:   uint64(length) - 1,
-	}
-	err = blob.WriteRange(br, bytes.NewReader(data), nil)
-	if err != nil {
-		return err
+	name := f
+	if len(f) < 5 || string(f[len(f)-4:]) != ".vhd" {
+		name = f + ".vhd"
 	}
 
-	return nil
+	pt.SetStage("Uploading " + name + ".")
+
+	return uploadPageBlob(&pageBlob{
+		url:      blobURL(p.cfg, p.cfg.Container, name),
+		auth:     p.blobAuth,
+		metadata: tags,
+	}, src, p.cfg.UploadWorkers, pt)
 }
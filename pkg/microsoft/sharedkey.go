@@ -0,0 +1,218 @@
+package microsoft
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storageVersion is the Storage REST API version requested by blobRequest.
+const storageVersion = "2016-05-31"
+
+// blobAuthorizer authorises a request to the Blob service.
+type blobAuthorizer interface {
+	Authorize(req *http.Request) error
+}
+
+// sharedKeySigner authorises Blob service requests with the SharedKey scheme,
+// signing each request with the storage account's access key.
+type sharedKeySigner struct {
+	account string
+	key     []byte
+}
+
+func newSharedKeySigner(account, key string) (*sharedKeySigner, error) {
+	dec, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad storage key: %v", err)
+	}
+
+	return &sharedKeySigner{
+		account: account,
+		key:     dec,
+	}, nil
+}
+
+// Authorize sets the x-ms-date header if it is missing and adds a SharedKey
+// Authorization header covering the request.
+func (s *sharedKeySigner) Authorize(req *http.Request) error {
+	if req.Header.Get("x-ms-date") == "" {
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	sig := s.sign(s.stringToSign(req))
+	req.Header.Set("Authorization", "SharedKey "+s.account+":"+sig)
+	return nil
+}
+
+func (s *sharedKeySigner) sign(stringToSign string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// stringToSign builds the string to sign for the Blob service as of version
+// 2015-02-21, where a zero Content-Length is represented by an empty string.
+func (s *sharedKeySigner) stringToSign(req *http.Request) string {
+	contentLength := req.Header.Get("Content-Length")
+	if contentLength == "" && req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if contentLength == "0" {
+		contentLength = ""
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalizedHeaders(req.Header) + s.canonicalizedResource(req.URL),
+	}, "\n")
+}
+
+// canonicalizedHeaders returns every x-ms- header, lowercased and sorted by
+// name, with folded whitespace in the values collapsed. Each entry ends in a
+// newline.
+func canonicalizedHeaders(h http.Header) string {
+	var names []string
+	for name := range h {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		var values []string
+		for _, v := range h[http.CanonicalHeaderKey(name)] {
+			values = append(values, strings.Join(strings.Fields(v), " "))
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	return b.String()
+}
+
+// canonicalizedResource returns the account and encoded path of u, followed
+// by each query parameter in lowercase, sorted order with sorted,
+// comma-separated values.
+func (s *sharedKeySigner) canonicalizedResource(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	var b strings.Builder
+	b.WriteString("/" + s.account + path)
+
+	params := make(map[string][]string)
+	var names []string
+	for name, values := range u.Query() {
+		lower := strings.ToLower(name)
+		if _, ok := params[lower]; !ok {
+			names = append(names, lower)
+		}
+		params[lower] = append(params[lower], values...)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		b.WriteString("\n" + name + ":" + strings.Join(values, ","))
+	}
+
+	return b.String()
+}
+
+// sasAuthorizer authorises Blob service requests by appending a shared access
+// signature to the query string.
+type sasAuthorizer struct {
+	token url.Values
+}
+
+func newSASAuthorizer(token string) (*sasAuthorizer, error) {
+	v, err := url.ParseQuery(strings.TrimPrefix(token, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("bad SAS token: %v", err)
+	}
+	if v.Get("sig") == "" {
+		return nil, errors.New("bad SAS token: missing signature")
+	}
+
+	return &sasAuthorizer{token: v}, nil
+}
+
+// Authorize adds the SAS parameters to the request URL.
+func (s *sasAuthorizer) Authorize(req *http.Request) error {
+	q := req.URL.Query()
+	for k, v := range s.token {
+		q[k] = v
+	}
+	req.URL.RawQuery = q.Encode()
+	return nil
+}
+
+func newBlobAuthorizer(cfg *Config) (blobAuthorizer, error) {
+	if cfg.SASToken != "" {
+		return newSASAuthorizer(cfg.SASToken)
+	}
+	return newSharedKeySigner(cfg.StorageAccount, cfg.StorageKey)
+}
+
+// blobURL returns the URL of a container, or of a blob within it if blob is
+// not empty.
+func blobURL(cfg *Config, container, blob string) string {
+	u := "https://" + cfg.StorageAccount + ".blob.core.windows.net/" + container
+	if blob != "" {
+		u += "/" + blob
+	}
+	return u
+}
+
+// blobRequest sends a request to the Blob service authorised by auth. The
+// x-ms-version header is set unless headers already contain one.
+func blobRequest(auth blobAuthorizer, verb string, url string, headers http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(verb, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+
+	// Add canonicalizes the keys, which the signature looks headers up by
+	for k, values := range headers {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	if req.Header.Get("x-ms-version") == "" {
+		req.Header.Set("x-ms-version", storageVersion)
+	}
+
+	err = auth.Authorize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,347 @@
+package microsoft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testStorageKey is the key of the storage emulator's development account.
+const testStorageKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func newTestSigner(t *testing.T) *sharedKeySigner {
+	s, err := newSharedKeySigner("myaccount", testStorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestRequest(t *testing.T, method, u string, headers map[string]string) *http.Request {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestStringToSign(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		length  int64
+		want    string
+	}{{
+		// the example in Azure's "Authorize with Shared Key" documentation
+		name:   "documented example",
+		method: "GET",
+		url:    "https://myaccount.blob.core.windows.net/myaccount/mycontainer?restype=container&comp=metadata&timeout=20",
+		headers: map[string]string{
+			"x-ms-date":    "Sun, 11 Oct 2009 21:49:13 GMT",
+			"x-ms-version": "2009-09-19",
+		},
+		want: "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+			"x-ms-date:Sun, 11 Oct 2009 21:49:13 GMT\nx-ms-version:2009-09-19\n" +
+			"/myaccount/myaccount/mycontainer\ncomp:metadata\nrestype:container\ntimeout:20",
+	}, {
+		name:   "empty content length",
+		method: "GET",
+		url:    "https://myaccount.blob.core.windows.net/mycontainer/myblob",
+		headers: map[string]string{
+			"x-ms-date":    "Sat, 21 Feb 2015 00:48:38 GMT",
+			"x-ms-version": "2015-02-21",
+		},
+		want: "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+			"x-ms-date:Sat, 21 Feb 2015 00:48:38 GMT\nx-ms-version:2015-02-21\n" +
+			"/myaccount/mycontainer/myblob",
+	}, {
+		name:   "zero content length header",
+		method: "PUT",
+		url:    "https://myaccount.blob.core.windows.net/mycontainer/myblob",
+		headers: map[string]string{
+			"Content-Length": "0",
+			"x-ms-version":   "2015-02-21",
+		},
+		want: "PUT\n\n\n\n\n\n\n\n\n\n\n\n" +
+			"x-ms-version:2015-02-21\n" +
+			"/myaccount/mycontainer/myblob",
+	}, {
+		name:   "page write",
+		method: "PUT",
+		url:    "https://myaccount.blob.core.windows.net/mycontainer/disk.vhd?comp=page",
+		headers: map[string]string{
+			"Content-Type":    "application/octet-stream",
+			"Content-MD5":     "Q2hlY2sgSW50ZWdyaXR5IQ==",
+			"If-Match":        `"0x8CB171BA9E94B0B"`,
+			"x-ms-range":      "bytes=0-511",
+			"x-ms-page-write": "update",
+			"x-ms-version":    "2016-05-31",
+		},
+		length: 512,
+		want: "PUT\n\n\n512\nQ2hlY2sgSW50ZWdyaXR5IQ==\napplication/octet-stream\n\n\n\"0x8CB171BA9E94B0B\"\n\n\n\n" +
+			"x-ms-page-write:update\nx-ms-range:bytes=0-511\nx-ms-version:2016-05-31\n" +
+			"/myaccount/mycontainer/disk.vhd\ncomp:page",
+	}, {
+		name:   "range",
+		method: "GET",
+		url:    "https://myaccount.blob.core.windows.net/mycontainer/myblob",
+		headers: map[string]string{
+			"Range":             "bytes=0-1023",
+			"If-Modified-Since": "Sat, 21 Feb 2015 00:48:38 GMT",
+		},
+		want: "GET\n\n\n\n\n\n\nSat, 21 Feb 2015 00:48:38 GMT\n\n\n\nbytes=0-1023\n" +
+			"/myaccount/mycontainer/myblob",
+	}}
+
+	s := newTestSigner(t)
+	for _, tt := range tests {
+		req := newTestRequest(t, tt.method, tt.url, tt.headers)
+		req.ContentLength = tt.length
+		if got := s.stringToSign(req); got != tt.want {
+			t.Errorf("%s: got string to sign\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalizedHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{{
+		name:   "none",
+		header: http.Header{"Content-Type": {"text/plain"}},
+		want:   "",
+	}, {
+		name: "sorted and lowercased",
+		header: http.Header{
+			"X-Ms-Version":   {"2015-02-21"},
+			"X-Ms-Date":      {"Sat, 21 Feb 2015 00:48:38 GMT"},
+			"X-Ms-Meta-Name": {"value"},
+			"Authorization":  {"ignored"},
+		},
+		want: "x-ms-date:Sat, 21 Feb 2015 00:48:38 GMT\nx-ms-meta-name:value\nx-ms-version:2015-02-21\n",
+	}, {
+		name:   "folded whitespace",
+		header: http.Header{"X-Ms-Meta-Name": {"  a   value\r\n   folded  "}},
+		want:   "x-ms-meta-name:a value folded\n",
+	}, {
+		name:   "several values",
+		header: http.Header{"X-Ms-Meta-Name": {"one", "two"}},
+		want:   "x-ms-meta-name:one,two\n",
+	}}
+
+	for _, tt := range tests {
+		if got := canonicalizedHeaders(tt.header); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalizedResource(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		// examples from Azure's "Authorize with Shared Key" documentation
+		{"https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata",
+			"/myaccount/mycontainer\ncomp:metadata\nrestype:container"},
+		{"https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=list&include=snapshots&include=metadata&include=uncommittedblobs",
+			"/myaccount/mycontainer\ncomp:list\ninclude:metadata,snapshots,uncommittedblobs\nrestype:container"},
+		{"https://myaccount-secondary.blob.core.windows.net/mycontainer/myblob",
+			"/myaccount/mycontainer/myblob"},
+
+		{"https://myaccount.blob.core.windows.net",
+			"/myaccount/"},
+		{"https://myaccount.blob.core.windows.net/mycontainer/my%20blob.vhd",
+			"/myaccount/mycontainer/my%20blob.vhd"},
+		{"https://myaccount.blob.core.windows.net/mycontainer?include=snapshots,metadata",
+			"/myaccount/mycontainer\ninclude:snapshots,metadata"},
+		{"https://myaccount.blob.core.windows.net/mycontainer?Comp=list&comp=metadata&restype=container",
+			"/myaccount/mycontainer\ncomp:list,metadata\nrestype:container"},
+		{"https://myaccount.blob.core.windows.net/mycontainer?prefix=a%2Fb&marker=",
+			"/myaccount/mycontainer\nmarker:\nprefix:a/b"},
+	}
+
+	s := newTestSigner(t)
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.canonicalizedResource(u); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+// testSignature is the HMAC-SHA256 of testStringToSign under testStorageKey,
+// computed independently of sign.
+const (
+	testStringToSign = "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Sat, 21 Feb 2015 00:48:38 GMT\nx-ms-version:2015-02-21\n" +
+		"/myaccount/mycontainer/myblob"
+	testSignature = "yZ2Q05RNscChhtWlQbqTpEdZpcVj0x1wDiusIbUh26c="
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		stringToSign string
+		want         string
+	}{
+		{testStringToSign, testSignature},
+		{"", "RNeMV4QhAsdhJ2sGUgufA/AfRsaKXZU2cEJdUsvj4NY="},
+	}
+
+	s := newTestSigner(t)
+	for _, tt := range tests {
+		if got := s.sign(tt.stringToSign); got != tt.want {
+			t.Errorf("%q: got signature %s, want %s", tt.stringToSign, got, tt.want)
+		}
+	}
+}
+
+func TestSharedKeyAuthorize(t *testing.T) {
+	s := newTestSigner(t)
+
+	req := newTestRequest(t, "GET", "https://myaccount.blob.core.windows.net/mycontainer/myblob", map[string]string{
+		"x-ms-date":    "Sat, 21 Feb 2015 00:48:38 GMT",
+		"x-ms-version": "2015-02-21",
+	})
+	err := s.Authorize(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("x-ms-date"); got != "Sat, 21 Feb 2015 00:48:38 GMT" {
+		t.Errorf("x-ms-date replaced with %s", got)
+	}
+	want := "SharedKey myaccount:" + testSignature
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("got Authorization %s, want %s", got, want)
+	}
+
+	req = newTestRequest(t, "GET", "https://myaccount.blob.core.windows.net/mycontainer/myblob", nil)
+	err = s.Authorize(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.ParseTime(req.Header.Get("x-ms-date")); err != nil {
+		t.Errorf("bad x-ms-date: %v", err)
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "SharedKey myaccount:") {
+		t.Errorf("got Authorization %s", req.Header.Get("Authorization"))
+	}
+}
+
+func TestNewSharedKeySigner(t *testing.T) {
+	_, err := newSharedKeySigner("myaccount", "not base64!")
+	if err == nil || !strings.HasPrefix(err.Error(), "bad storage key: ") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestSASAuthorize(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		url   string
+		want  url.Values
+		err   string
+	}{{
+		name:  "no query",
+		token: "sv=2016-05-31&sr=c&sp=rw&sig=a%2Bb%2Fc%3D",
+		url:   "https://myaccount.blob.core.windows.net/mycontainer/disk.vhd",
+		want:  url.Values{"sv": {"2016-05-31"}, "sr": {"c"}, "sp": {"rw"}, "sig": {"a+b/c="}},
+	}, {
+		name:  "existing params kept",
+		token: "?sv=2016-05-31&sig=abc",
+		url:   "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=list&include=snapshots&include=metadata",
+		want: url.Values{
+			"restype": {"container"},
+			"comp":    {"list"},
+			"include": {"snapshots", "metadata"},
+			"sv":      {"2016-05-31"},
+			"sig":     {"abc"},
+		},
+	}, {
+		name:  "token wins",
+		token: "sv=2016-05-31&sig=abc",
+		url:   "https://myaccount.blob.core.windows.net/mycontainer/disk.vhd?comp=page&sig=stale",
+		want:  url.Values{"comp": {"page"}, "sv": {"2016-05-31"}, "sig": {"abc"}},
+	}, {
+		name:  "missing signature",
+		token: "sv=2016-05-31&sr=c",
+		err:   "bad SAS token: missing signature",
+	}, {
+		name:  "malformed",
+		token: "sig=%zz",
+		err:   "bad SAS token: ",
+	}}
+
+	for _, tt := range tests {
+		s, err := newSASAuthorizer(tt.token)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		req := newTestRequest(t, "PUT", tt.url, nil)
+		path := req.URL.Path
+		err = s.Authorize(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.URL.Path != path {
+			t.Errorf("%s: path changed to %s", tt.name, req.URL.Path)
+		}
+		got := req.URL.Query()
+		if got.Encode() != tt.want.Encode() {
+			t.Errorf("%s: got query %s, want %s", tt.name, got.Encode(), tt.want.Encode())
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("%s: Authorization header set", tt.name)
+		}
+	}
+}
+
+func TestBlobRequestSignsHeaders(t *testing.T) {
+	s := newTestSigner(t)
+
+	// the keys are not in canonical form, as callers may well write them
+	headers := http.Header{
+		"x-ms-date":  {"Sat, 21 Feb 2015 00:48:38 GMT"},
+		"x-ms-range": {"bytes=0-511"},
+	}
+	want := "SharedKey myaccount:" + s.sign("PUT\n\n\n\n\n\n\n\n\n\n\n\n"+
+		"x-ms-date:Sat, 21 Feb 2015 00:48:38 GMT\nx-ms-range:bytes=0-511\nx-ms-version:"+storageVersion+"\n"+
+		"/myaccount/mycontainer/disk.vhd\ncomp:page")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("x-ms-range"); got != "bytes=0-511" {
+			t.Errorf("got x-ms-range %q", got)
+		}
+		if got := r.Header.Get("Authorization"); got != want {
+			t.Errorf("got Authorization %s, want %s", got, want)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	resp, err := blobRequest(s, "PUT", srv.URL+"/mycontainer/disk.vhd?comp=page", headers, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,286 @@
+package microsoft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
+)
+
+const (
+	pageSize          = 512                           // page blobs are written in 512 byte pages
+	maxPutPage        = 4 * 1024 * 1024               // largest range accepted by a single Put Page
+	maxPageBlobSize   = 8 * 1024 * 1024 * 1024 * 1024 // largest page blob the Blob service allows
+	defaultWorkers    = 8                             // concurrent Put Page requests if Config.UploadWorkers is unset
+	putPageRetries    = 5                             // attempts made for each range before giving up
+	putPageRetryDelay = 2 * time.Second               // doubled after each failed attempt
+)
+
+// pageRange is a run of pages to be written at offset, and the chunk of the
+// disk it belongs to.
+type pageRange struct {
+	offset int64
+	data   []byte
+	chunk  *chunkProgress
+}
+
+// chunkProgress tracks the outstanding ranges of a diskChunk so that its
+// consumed bytes are reported only once all of them have been written.
+type chunkProgress struct {
+	remaining int32
+	consumed  int64
+}
+
+// roundUp rounds n up to a multiple of m.
+func roundUp(n, m int64) int64 {
+	if n%m == 0 {
+		return n
+	}
+	return n + m - n%m
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nonZeroRanges splits a chunk read from offset into runs of pages that
+// contain data, none longer than maxPutPage. The chunk must be a multiple of
+// pageSize.
+func nonZeroRanges(offset int64, chunk []byte) []pageRange {
+	var ranges []pageRange
+	start := -1
+	for i := 0; i < len(chunk); i += pageSize {
+		if start >= 0 && i-start == maxPutPage {
+			ranges = append(ranges, pageRange{offset: offset + int64(start), data: chunk[start:i]})
+			start = -1
+		}
+		if isZero(chunk[i : i+pageSize]) {
+			if start >= 0 {
+				ranges = append(ranges, pageRange{offset: offset + int64(start), data: chunk[start:i]})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, pageRange{offset: offset + int64(start), data: chunk[start:]})
+	}
+	return ranges
+}
+
+// pageBlob is the destination of an upload.
+type pageBlob struct {
+	url      string            // URL of the blob, without any SAS token
+	auth     blobAuthorizer    // authorises requests to the blob
+	size     int64             // size of a blob that already exists, or 0 if it must be created
+	metadata map[string]string // metadata set on a blob when it is created
+}
+
+func createPageBlob(b *pageBlob, size int64) error {
+	headers := http.Header{}
+	headers.Set("x-ms-blob-type", "PageBlob")
+	headers.Set("x-ms-blob-content-length", strconv.FormatInt(size, 10))
+	headers.Set("x-ms-blob-content-type", "application/octet-stream")
+	for k, v := range b.metadata {
+		headers.Set("x-ms-meta-"+k, v)
+	}
+
+	resp, err := blobRequest(b.auth, "PUT", b.url, headers, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func resizePageBlob(b *pageBlob, size int64) error {
+	headers := http.Header{}
+	headers.Set("x-ms-blob-content-length", strconv.FormatInt(size, 10))
+
+	resp, err := blobRequest(b.auth, "PUT", b.url+"?comp=properties", headers, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// deletePageBlob removes the blob b.
+func deletePageBlob(b *pageBlob) error {
+	resp, err := blobRequest(b.auth, "DELETE", b.url, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func putPage(b *pageBlob, r pageRange) error {
+	headers := http.Header{}
+	headers.Set("x-ms-page-write", "update")
+	headers.Set("x-ms-range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+int64(len(r.data))-1))
+
+	resp, err := blobRequest(b.auth, "PUT", b.url+"?comp=page", headers, bytes.NewReader(r.data), int64(len(r.data)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return &upload.StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// putPageWithRetry writes r, retrying with exponential backoff on transient
+// failures.
+func putPageWithRetry(b *pageBlob, r pageRange) error {
+	err := upload.Retry(putPageRetries, putPageRetryDelay, func() error {
+		return putPage(b, r)
+	})
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("writing bytes %d-%d: %v", r.offset, r.offset+int64(len(r.data))-1, err)
+}
+
+// uploadPageBlob writes the disk produced by src into the page blob b,
+// followed by a fixed VHD footer. A new blob is created with the virtual size
+// rounded up to a whole MiB; an existing blob keeps its size, with the footer
+// in its last page. Pages that are entirely zero are skipped, since a new page
+// blob already reads as zeros, and the rest are written by concurrent workers.
+// Progress is reported to pt in bytes of input consumed. A blob created by
+// uploadPageBlob is deleted again if the upload fails.
+func uploadPageBlob(b *pageBlob, src diskSource, workers int, pt progress.ProgressTracker) (err error) {
+
+	blobSize := b.size
+	if blobSize == 0 {
+		blobSize = int64(maxPageBlobSize)
+		if max := src.maxSize(); max >= 0 {
+			blobSize = roundUp(max, vhdAlignment) + vhdFooterSize
+		}
+
+		// a disk of unknown size is written into the largest possible blob,
+		// which is shrunk to fit once the input ends
+		err = createPageBlob(b, blobSize)
+		if err != nil {
+			return err
+		}
+
+		// the upload error says more than any from deleting
+		defer func() {
+			if err != nil {
+				deletePageBlob(b)
+			}
+		}()
+	}
+
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	pool := upload.NewPool(workers, pt)
+
+	func() {
+		for {
+			c, err := src.next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				pool.Fail(err)
+				return
+			}
+
+			// pad a partial final page with zeros
+			data := c.data
+			if pad := roundUp(int64(len(data)), pageSize) - int64(len(data)); pad > 0 {
+				data = append(data, make([]byte, pad)...)
+			}
+
+			ranges := nonZeroRanges(c.offset, data)
+			if len(ranges) == 0 {
+				if c.consumed > 0 {
+					pool.Advance(c.consumed)
+				}
+				continue
+			}
+
+			cp := &chunkProgress{
+				remaining: int32(len(ranges)),
+				consumed:  c.consumed,
+			}
+			for _, job := range ranges {
+				job := job
+				job.chunk = cp
+				ok := pool.Submit(func() (int64, error) {
+					err := putPageWithRetry(b, job)
+					if err != nil {
+						return 0, err
+					}
+					if atomic.AddInt32(&job.chunk.remaining, -1) == 0 {
+						return job.chunk.consumed, nil
+					}
+					return 0, nil
+				})
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	err = pool.Wait()
+	if err != nil {
+		return err
+	}
+
+	size := roundUp(src.size(), vhdAlignment)
+	if b.size != 0 {
+		if size+vhdFooterSize > b.size {
+			return fmt.Errorf("disk of %d bytes does not fit in blob of %d bytes", size, b.size)
+		}
+		size = b.size - vhdFooterSize
+	} else if size+vhdFooterSize != blobSize {
+		err = resizePageBlob(b, size+vhdFooterSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	footer, err := newFixedVHDFooter(size)
+	if err != nil {
+		return err
+	}
+
+	return putPageWithRetry(b, pageRange{offset: size, data: footer})
+}
@@ -0,0 +1,281 @@
+package microsoft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/sisatech/progress"
+)
+
+// span is the offset and length of a range of pages.
+type span struct {
+	offset int64
+	length int
+}
+
+func TestNonZeroRanges(t *testing.T) {
+	const base = 1 << 30
+	data := func(pages int) []byte { return testData(pages * pageSize) }
+	zero := func(pages int) []byte { return make([]byte, pages*pageSize) }
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	full := maxPutPage / pageSize
+
+	tests := []struct {
+		name  string
+		chunk []byte
+		want  []span
+	}{
+		{"empty", nil, nil},
+		{"zeros", zero(4), nil},
+		{"one page", data(1), []span{{base, pageSize}}},
+		{"leading zeros", join(zero(2), data(3)), []span{{base + 2*pageSize, 3 * pageSize}}},
+		{"two runs", join(data(1), zero(2), data(2), zero(1)), []span{{base, pageSize}, {base + 3*pageSize, 2 * pageSize}}},
+		{"cut at the largest put", data(full + 1), []span{{base, maxPutPage}, {base + maxPutPage, pageSize}}},
+		{"cut before zeros", join(data(full), zero(1), data(1)), []span{{base, maxPutPage}, {base + maxPutPage + pageSize, pageSize}}},
+		{"cut twice", data(2 * full), []span{{base, maxPutPage}, {base + maxPutPage, maxPutPage}}},
+	}
+
+	for _, tt := range tests {
+		var got []span
+		for _, r := range nonZeroRanges(base, tt.chunk) {
+			got = append(got, span{r.offset, len(r.data)})
+			if !bytes.Equal(r.data, tt.chunk[r.offset-base:r.offset-base+int64(len(r.data))]) {
+				t.Errorf("%s: range at %d holds the wrong data", tt.name, r.offset)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got ranges %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// nopAuthorizer leaves requests unauthorised.
+type nopAuthorizer struct{}
+
+func (nopAuthorizer) Authorize(req *http.Request) error { return nil }
+
+// testDiskSource returns chunks as they are given.
+type testDiskSource struct {
+	chunks []*diskChunk
+	max    int64
+	total  int64
+}
+
+func (d *testDiskSource) next() (*diskChunk, error) {
+	if len(d.chunks) == 0 {
+		return nil, io.EOF
+	}
+	c := d.chunks[0]
+	d.chunks = d.chunks[1:]
+	return c, nil
+}
+
+func (d *testDiskSource) maxSize() int64 { return d.max }
+func (d *testDiskSource) size() int64    { return d.total }
+
+// testPageBlob serves a single page blob, recording what is done to it.
+type testPageBlob struct {
+	t      *testing.T
+	reject int64 // offset of a Put Page answered with 400 Bad Request, if not -1
+
+	lock    sync.Mutex
+	created int64 // size the blob was created with
+	resized int64 // size the blob was last resized to
+	deleted bool
+	writes  map[int64][]byte // Put Page bodies by offset
+}
+
+func (b *testPageBlob) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	size := func(header string) int64 {
+		n, err := strconv.ParseInt(r.Header.Get(header), 10, 64)
+		if err != nil {
+			b.t.Errorf("bad %s: %v", header, err)
+		}
+		return n
+	}
+
+	switch {
+	case r.Method == "DELETE":
+		b.deleted = true
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == "PUT" && r.URL.RawQuery == "":
+		if r.Header.Get("x-ms-blob-type") != "PageBlob" {
+			b.t.Errorf("created a %s blob", r.Header.Get("x-ms-blob-type"))
+		}
+		b.created = size("x-ms-blob-content-length")
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "PUT" && r.URL.RawQuery == "comp=properties":
+		b.resized = size("x-ms-blob-content-length")
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == "PUT" && r.URL.RawQuery == "comp=page":
+		var start, end int64
+		_, err := fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end)
+		if err != nil {
+			b.t.Errorf("bad x-ms-range %q", r.Header.Get("x-ms-range"))
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			b.t.Error(err)
+		}
+		if int64(len(body)) != end-start+1 || start%pageSize != 0 || len(body)%pageSize != 0 || len(body) > maxPutPage {
+			b.t.Errorf("bad write of %d bytes to %s", len(body), r.Header.Get("x-ms-range"))
+		}
+		if start == b.reject {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.writes[start] = body
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		b.t.Errorf("unexpected %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestUploadPageBlob(t *testing.T) {
+	const mib = 1024 * 1024
+
+	// a disk of 3260 bytes, in three chunks: two runs of pages with data, a
+	// chunk of zeros, and a partial page
+	first := bytes.Join([][]byte{testData(pageSize), make([]byte, pageSize), testData(pageSize)}, nil)
+	last := testData(700)
+	chunks := func() []*diskChunk {
+		return []*diskChunk{
+			{offset: 0, data: first, consumed: 1536},
+			{offset: 1536, data: make([]byte, 1024), consumed: 1024},
+			{offset: 2560, data: append([]byte(nil), last...), consumed: 700},
+		}
+	}
+	wantWrites := map[int64][]byte{
+		0:    testData(pageSize),
+		1024: testData(pageSize),
+		2560: append(append([]byte(nil), last...), make([]byte, 2*pageSize-700)...),
+	}
+	long := testData(maxPutPage + pageSize)
+
+	tests := []struct {
+		name     string
+		size     int64 // of an existing blob
+		src      *testDiskSource
+		reject   int64
+		created  int64
+		resized  int64
+		writes   map[int64][]byte // excluding the footer
+		footer   int64            // offset of the footer
+		consumed int64
+		err      string
+	}{{
+		name:     "new blob",
+		src:      &testDiskSource{chunks: chunks(), max: 3260, total: 3260},
+		created:  mib + vhdFooterSize,
+		writes:   wantWrites,
+		footer:   mib,
+		consumed: 3260,
+	}, {
+		name:     "unknown size",
+		src:      &testDiskSource{chunks: chunks(), max: -1, total: 3260},
+		created:  maxPageBlobSize,
+		resized:  mib + vhdFooterSize,
+		writes:   wantWrites,
+		footer:   mib,
+		consumed: 3260,
+	}, {
+		name:     "existing blob",
+		size:     4*mib + vhdFooterSize,
+		src:      &testDiskSource{chunks: chunks(), max: 3260, total: 3260},
+		writes:   wantWrites,
+		footer:   4 * mib,
+		consumed: 3260,
+	}, {
+		name: "existing blob too small",
+		size: mib,
+		src:  &testDiskSource{chunks: chunks(), max: 3260, total: 3260},
+		err:  "disk of 1048576 bytes does not fit in blob of 1048576 bytes",
+	}, {
+		name:     "longer than a single put",
+		src:      &testDiskSource{chunks: []*diskChunk{{offset: 0, data: long, consumed: int64(len(long))}}, max: int64(len(long)), total: int64(len(long))},
+		created:  5*mib + vhdFooterSize,
+		writes:   map[int64][]byte{0: long[:maxPutPage], maxPutPage: long[maxPutPage:]},
+		footer:   5 * mib,
+		consumed: int64(len(long)),
+	}, {
+		name:    "rejected write",
+		src:     &testDiskSource{chunks: chunks(), max: 3260, total: 3260},
+		reject:  1024,
+		created: mib + vhdFooterSize,
+		err:     "writing bytes 1024-1535: bad status code 400",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.reject == 0 {
+				tt.reject = -1
+			}
+			blob := &testPageBlob{t: t, reject: tt.reject, writes: make(map[int64][]byte)}
+			srv := httptest.NewServer(blob)
+			defer srv.Close()
+
+			pt := progress.NewProgressTracker()
+			pt.Initialize("Uploading.", 0, progress.UnitBytes)
+
+			err := uploadPageBlob(&pageBlob{url: srv.URL + "/container/disk.vhd", auth: nopAuthorizer{}, size: tt.size}, tt.src, 1, pt)
+
+			blob.lock.Lock()
+			defer blob.lock.Unlock()
+
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				if blob.deleted != (tt.size == 0) {
+					t.Errorf("got blob deleted %v", blob.deleted)
+				}
+				// the first chunk is only counted once all of its pages are
+				// written
+				if got := pt.Status().Progress; tt.reject >= 0 && got >= 1536 {
+					t.Errorf("got progress %v after failing to write the first chunk", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if blob.created != tt.created || blob.resized != tt.resized || blob.deleted {
+				t.Errorf("got blob created at %d, resized to %d, deleted %v", blob.created, blob.resized, blob.deleted)
+			}
+
+			f := parseVHDFooter(blob.writes[tt.footer])
+			if f == nil || f.diskType != vhdFixed || f.currentSize != tt.footer {
+				t.Errorf("got footer %+v at %d", f, tt.footer)
+			}
+			delete(blob.writes, tt.footer)
+			if !reflect.DeepEqual(blob.writes, tt.writes) {
+				var got []span
+				for off, b := range blob.writes {
+					got = append(got, span{off, len(b)})
+				}
+				t.Errorf("got writes %v", got)
+			}
+
+			if got := pt.Status().Progress; got != float64(tt.consumed) {
+				t.Errorf("got progress %v, want %d", got, tt.consumed)
+			}
+		})
+	}
+}
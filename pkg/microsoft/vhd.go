@@ -0,0 +1,416 @@
+package microsoft
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+const (
+	vhdFooterSize    = 512              // size of the footer that ends every VHD
+	vhdAlignment     = 1024 * 1024      // Azure requires the virtual size of a VHD to be a whole MiB
+	vhdCookie        = "conectix"       // identifies a VHD footer
+	vhdDynamicCookie = "cxsparse"       // identifies a dynamic disk header
+	vhdHeaderSize    = 1024             // size of a dynamic disk header
+	vhdFixed         = 2                // disk type of a fixed VHD
+	vhdDynamic       = 3                // disk type of a dynamic VHD
+	vhdDifferencing  = 4                // disk type of a differencing VHD
+	vhdUnallocated   = 0xFFFFFFFF       // BAT entry of a block that holds no data
+	vhdNoDataOffset  = ^uint64(0)       // data offset of a fixed VHD
+	vhdEpoch         = 946684800        // 2000-01-01T00:00:00Z, the VHD timestamp epoch
+	vhdMaxSectors    = 65535 * 16 * 255 // largest disk the CHS geometry can describe
+)
+
+// vhdFooter holds the fields of a VHD footer used by the provisioner.
+type vhdFooter struct {
+	dataOffset  uint64
+	currentSize int64
+	diskType    uint32
+}
+
+// vhdChecksum returns the one's complement of the sum of every byte in b,
+// skipping the checksum field itself.
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i >= 64 && i < 68 {
+			continue
+		}
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// parseVHDFooter returns the footer held in b, or nil if b is not a valid
+// VHD footer.
+func parseVHDFooter(b []byte) *vhdFooter {
+	if len(b) != vhdFooterSize || string(b[:8]) != vhdCookie {
+		return nil
+	}
+	if binary.BigEndian.Uint32(b[64:68]) != vhdChecksum(b) {
+		return nil
+	}
+	return &vhdFooter{
+		dataOffset:  binary.BigEndian.Uint64(b[16:24]),
+		currentSize: int64(binary.BigEndian.Uint64(b[48:56])),
+		diskType:    binary.BigEndian.Uint32(b[60:64]),
+	}
+}
+
+// vhdGeometry calculates the CHS geometry of a disk of size bytes using the
+// algorithm from the VHD specification.
+func vhdGeometry(size int64) (cylinders uint16, heads, sectors uint8) {
+	total := size / 512
+	if total > vhdMaxSectors {
+		total = vhdMaxSectors
+	}
+
+	var spt, h, cth int64
+	if total >= 65535*16*63 {
+		spt = 255
+		h = 16
+		cth = total / spt
+	} else {
+		spt = 17
+		cth = total / spt
+		h = (cth + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cth >= h*1024 || h > 16 {
+			spt = 31
+			h = 16
+			cth = total / spt
+		}
+		if cth >= h*1024 {
+			spt = 63
+			h = 16
+			cth = total / spt
+		}
+	}
+
+	return uint16(cth / h), uint8(h), uint8(spt)
+}
+
+// newFixedVHDFooter builds the footer of a fixed VHD with a virtual size of
+// size bytes.
+func newFixedVHDFooter(size int64) ([]byte, error) {
+	b := make([]byte, vhdFooterSize)
+	copy(b[0:8], vhdCookie)
+	binary.BigEndian.PutUint32(b[8:12], 2)           // features: reserved bit is always set
+	binary.BigEndian.PutUint32(b[12:16], 0x00010000) // file format version 1.0
+	binary.BigEndian.PutUint64(b[16:24], vhdNoDataOffset)
+	binary.BigEndian.PutUint32(b[24:28], uint32(time.Now().Unix()-vhdEpoch))
+	copy(b[28:32], "prov")
+	binary.BigEndian.PutUint32(b[32:36], 0x00010000)
+	copy(b[36:40], "Wi2k")
+	binary.BigEndian.PutUint64(b[40:48], uint64(size))
+	binary.BigEndian.PutUint64(b[48:56], uint64(size))
+
+	c, h, s := vhdGeometry(size)
+	binary.BigEndian.PutUint16(b[56:58], c)
+	b[58] = h
+	b[59] = s
+
+	binary.BigEndian.PutUint32(b[60:64], vhdFixed)
+
+	_, err := io.ReadFull(rand.Reader, b[68:84])
+	if err != nil {
+		return nil, err
+	}
+	b[74] = b[74]&0x0f | 0x40 // version 4 UUID
+	b[76] = b[76]&0x3f | 0x80
+
+	binary.BigEndian.PutUint32(b[64:68], vhdChecksum(b))
+
+	return b, nil
+}
+
+// diskChunk is a piece of the disk to be written at offset, along with the
+// number of input bytes consumed to produce it.
+type diskChunk struct {
+	offset   int64
+	data     []byte
+	consumed int64
+}
+
+// diskSource converts an input image into the data of a fixed VHD, without
+// its footer.
+type diskSource interface {
+	// next returns the next chunk of disk data, or io.EOF once the input is
+	// exhausted. Chunks may be returned in any order and may hold no data.
+	next() (*diskChunk, error)
+
+	// maxSize returns an upper bound of the disk size before the input has
+	// been read, or -1 if it is unknown.
+	maxSize() int64
+
+	// size returns the disk size once next has returned io.EOF.
+	size() int64
+}
+
+// openDisk detects the format of the image in r, which holds inputSize bytes
+// or -1 if unknown. Dynamic VHDs are expanded; anything else is treated as a
+// raw disk, with any fixed VHD footer at its end removed.
+func openDisk(r io.Reader, inputSize int64) (diskSource, error) {
+	br := bufio.NewReader(r)
+
+	b, err := br.Peek(vhdFooterSize)
+	if err == nil {
+		if f := parseVHDFooter(b); f != nil {
+			switch f.diskType {
+			case vhdDynamic:
+				return newDynamicDisk(br, f)
+			case vhdDifferencing:
+				return nil, errors.New("differencing VHDs are not supported")
+			}
+		}
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	return &rawDisk{r: br, inputSize: inputSize}, nil
+}
+
+// rawDisk reads a raw disk image. The last vhdFooterSize bytes read are held
+// back until the end of the input so that the footer of a fixed VHD can be
+// detected and dropped.
+type rawDisk struct {
+	r         io.Reader
+	inputSize int64
+	held      []byte
+	offset    int64
+	done      bool
+}
+
+func (d *rawDisk) next() (*diskChunk, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+
+	buf := make([]byte, maxPutPage+vhdFooterSize)
+	n := copy(buf, d.held)
+	m, err := io.ReadFull(d.r, buf[n:])
+	n += m
+
+	if err == nil {
+		d.held = append(d.held[:0], buf[maxPutPage:]...)
+		c := &diskChunk{
+			offset:   d.offset,
+			data:     buf[:maxPutPage],
+			consumed: int64(m),
+		}
+		d.offset += maxPutPage
+		return c, nil
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	d.done = true
+	buf = buf[:n]
+
+	if n >= vhdFooterSize {
+		f := parseVHDFooter(buf[n-vhdFooterSize:])
+		if f != nil && f.diskType == vhdFixed && f.currentSize == d.offset+int64(n-vhdFooterSize) {
+			buf = buf[:n-vhdFooterSize]
+		}
+	}
+
+	c := &diskChunk{
+		offset:   d.offset,
+		data:     buf,
+		consumed: int64(m),
+	}
+	d.offset += int64(len(buf))
+	return c, nil
+}
+
+func (d *rawDisk) maxSize() int64 {
+	return d.inputSize
+}
+
+func (d *rawDisk) size() int64 {
+	return d.offset
+}
+
+// dynamicDisk expands a dynamic VHD read sequentially. Its block allocation
+// table must precede every block, which is how all common tools lay it out.
+type dynamicDisk struct {
+	r          io.Reader
+	pos        int64 // bytes read from r
+	reported   int64 // bytes of r accounted for in returned chunks
+	footer     *vhdFooter
+	blockSize  int64
+	bitmapSize int64
+	blocks     []int64 // file offsets of allocated blocks, in file order
+	index      map[int64]int64
+	done       bool
+}
+
+func newDynamicDisk(r io.Reader, f *vhdFooter) (*dynamicDisk, error) {
+	d := &dynamicDisk{
+		r:      r,
+		footer: f,
+		index:  make(map[int64]int64),
+	}
+
+	err := d.skipTo(vhdFooterSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.skipTo(int64(f.dataOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, vhdHeaderSize)
+	err = d.read(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:8]) != vhdDynamicCookie {
+		return nil, errors.New("bad dynamic VHD header")
+	}
+
+	tableOffset := int64(binary.BigEndian.Uint64(hdr[16:24]))
+	entries := int64(binary.BigEndian.Uint32(hdr[28:32]))
+	d.blockSize = int64(binary.BigEndian.Uint32(hdr[32:36]))
+	if d.blockSize == 0 || d.blockSize%pageSize != 0 {
+		return nil, fmt.Errorf("bad dynamic VHD block size %d", d.blockSize)
+	}
+	d.bitmapSize = roundUp((d.blockSize/512+7)/8, 512)
+
+	// entries comes from the file, so it is checked before the table is
+	// allocated
+	if max := (f.currentSize + d.blockSize - 1) / d.blockSize; entries > max {
+		return nil, fmt.Errorf("dynamic VHD has %d table entries for %d blocks", entries, max)
+	}
+
+	err = d.skipTo(tableOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	bat := make([]byte, entries*4)
+	err = d.read(bat)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := int64(0); i < entries; i++ {
+		sector := binary.BigEndian.Uint32(bat[i*4:])
+		if sector == vhdUnallocated {
+			continue
+		}
+		off := int64(sector) * 512
+		if off < d.pos {
+			return nil, errors.New("dynamic VHD blocks must follow the block allocation table")
+		}
+		d.blocks = append(d.blocks, off)
+		d.index[off] = i * d.blockSize
+	}
+	sort.Slice(d.blocks, func(i, j int) bool { return d.blocks[i] < d.blocks[j] })
+
+	return d, nil
+}
+
+func (d *dynamicDisk) read(b []byte) error {
+	n, err := io.ReadFull(d.r, b)
+	d.pos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("unexpected end of dynamic VHD")
+	}
+	return err
+}
+
+func (d *dynamicDisk) skipTo(off int64) error {
+	if off < d.pos {
+		return errors.New("unsupported dynamic VHD layout")
+	}
+	n, err := io.CopyN(ioutil.Discard, d.r, off-d.pos)
+	d.pos += n
+	if err == io.EOF {
+		return errors.New("unexpected end of dynamic VHD")
+	}
+	return err
+}
+
+func (d *dynamicDisk) next() (*diskChunk, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+
+	if len(d.blocks) == 0 {
+		// drain the trailing footer so that all input is accounted for
+		n, err := io.Copy(ioutil.Discard, d.r)
+		d.pos += n
+		if err != nil {
+			return nil, err
+		}
+		d.done = true
+		c := &diskChunk{consumed: d.pos - d.reported}
+		d.reported = d.pos
+		return c, nil
+	}
+
+	off := d.blocks[0]
+	d.blocks = d.blocks[1:]
+
+	err := d.skipTo(off)
+	if err != nil {
+		return nil, err
+	}
+
+	bitmap := make([]byte, d.bitmapSize)
+	err = d.read(bitmap)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, d.blockSize)
+	err = d.read(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// sectors not marked present in the bitmap read as zeros
+	for i := int64(0); i < d.blockSize/512; i++ {
+		if bitmap[i/8]&(0x80>>uint(i%8)) == 0 {
+			sector := data[i*512 : (i+1)*512]
+			for j := range sector {
+				sector[j] = 0
+			}
+		}
+	}
+
+	virtual := d.index[off]
+	if virtual >= d.footer.currentSize {
+		data = nil
+	} else if virtual+d.blockSize > d.footer.currentSize {
+		data = data[:d.footer.currentSize-virtual]
+	}
+
+	c := &diskChunk{
+		offset:   virtual,
+		data:     data,
+		consumed: d.pos - d.reported,
+	}
+	d.reported = d.pos
+	return c, nil
+}
+
+func (d *dynamicDisk) maxSize() int64 {
+	return d.footer.currentSize
+}
+
+func (d *dynamicDisk) size() int64 {
+	return d.footer.currentSize
+}
@@ -0,0 +1,334 @@
+package microsoft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestVHDGeometry(t *testing.T) {
+	// worked through the algorithm in the VHD specification by hand
+	tests := []struct {
+		size      int64
+		cylinders uint16
+		heads     uint8
+		sectors   uint8
+	}{
+		{1 << 20, 30, 4, 17},
+		{100 << 20, 1003, 12, 17},
+		{200 << 20, 825, 16, 31},
+		{30 << 30, 62415, 16, 63},
+		{127 << 30, 65278, 16, 255},
+		{2 << 40, 65535, 16, 255}, // larger than the geometry can describe
+	}
+
+	for _, tt := range tests {
+		c, h, s := vhdGeometry(tt.size)
+		if c != tt.cylinders || h != tt.heads || s != tt.sectors {
+			t.Errorf("%d: got geometry %d/%d/%d, want %d/%d/%d", tt.size, c, h, s, tt.cylinders, tt.heads, tt.sectors)
+		}
+	}
+}
+
+func TestVHDChecksum(t *testing.T) {
+	withChecksumField := make([]byte, vhdFooterSize)
+	copy(withChecksumField[64:68], []byte{0xff, 0xff, 0xff, 0xff})
+	withChecksumField[0] = 1
+
+	tests := []struct {
+		name string
+		b    []byte
+		want uint32
+	}{
+		{"zeros", make([]byte, vhdFooterSize), 0xffffffff},
+		{"sum", []byte{1, 2, 3}, ^uint32(6)},
+		{"checksum field skipped", withChecksumField, ^uint32(1)},
+	}
+
+	for _, tt := range tests {
+		if got := vhdChecksum(tt.b); got != tt.want {
+			t.Errorf("%s: got checksum %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFixedVHDFooter(t *testing.T) {
+	for _, size := range []int64{1 << 20, 30 << 30} {
+		b, err := newFixedVHDFooter(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := parseVHDFooter(b)
+		if f == nil {
+			t.Fatalf("%d: footer did not parse", size)
+		}
+		if f.dataOffset != vhdNoDataOffset || f.currentSize != size || f.diskType != vhdFixed {
+			t.Errorf("%d: got footer %+v", size, f)
+		}
+		if original := int64(binary.BigEndian.Uint64(b[40:48])); original != size {
+			t.Errorf("%d: got original size %d", size, original)
+		}
+		c, h, s := vhdGeometry(size)
+		if binary.BigEndian.Uint16(b[56:58]) != c || b[58] != h || b[59] != s {
+			t.Errorf("%d: got geometry %x", size, b[56:60])
+		}
+		if b[74]>>4 != 4 || b[76]>>6 != 2 {
+			t.Errorf("%d: unique id %x is not a version 4 UUID", size, b[68:84])
+		}
+
+		corrupt := append([]byte(nil), b...)
+		corrupt[100] ^= 1
+		if parseVHDFooter(corrupt) != nil {
+			t.Errorf("%d: footer with a bad checksum parsed", size)
+		}
+		if parseVHDFooter(b[:vhdFooterSize-1]) != nil {
+			t.Errorf("%d: short footer parsed", size)
+		}
+	}
+}
+
+// readDisk reads every chunk of d into a buffer, checking that the input
+// consumed adds up to inputSize.
+func readDisk(t *testing.T, d diskSource, inputSize int64) []byte {
+	t.Helper()
+
+	var disk []byte
+	var consumed int64
+	for {
+		c, err := d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		consumed += c.consumed
+		if end := c.offset + int64(len(c.data)); end > int64(len(disk)) {
+			disk = append(disk, make([]byte, end-int64(len(disk)))...)
+		}
+		copy(disk[c.offset:], c.data)
+	}
+
+	if consumed != inputSize {
+		t.Errorf("consumed %d bytes of %d", consumed, inputSize)
+	}
+	if d.size() != int64(len(disk)) {
+		t.Errorf("got size %d for %d bytes of disk", d.size(), len(disk))
+	}
+	return disk
+}
+
+// testData returns n bytes of a pattern that no page of zeros or VHD footer
+// matches.
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i%251) + 1
+	}
+	return b
+}
+
+func TestRawDisk(t *testing.T) {
+	footer := func(size int64) []byte {
+		b, err := newFixedVHDFooter(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	large := testData(maxPutPage + 3000)
+	other := append(testData(4096), footer(8192)...)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{"raw", testData(3000), testData(3000)},
+		{"shorter than a footer", testData(100), testData(100)},
+		{"fixed VHD", append(testData(4096), footer(4096)...), testData(4096)},
+		{"footer of another size", other, other},
+		{"fixed VHD over several chunks", append(append([]byte(nil), large...), footer(int64(len(large)))...), large},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := openDisk(bytes.NewReader(tt.input), int64(len(tt.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := d.(*rawDisk); !ok {
+				t.Fatalf("opened as %T", d)
+			}
+			if d.maxSize() != int64(len(tt.input)) {
+				t.Errorf("got max size %d", d.maxSize())
+			}
+			if got := readDisk(t, d, int64(len(tt.input))); !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes of disk, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+// testDynamicVHD is a dynamic VHD of currentSize bytes with blocks of
+// blockSize bytes. Each entry of blocks is written to the file in order, as
+// the block at index with the given sector bitmap.
+type testDynamicVHD struct {
+	currentSize int64
+	blockSize   int64
+	entries     uint32
+	blocks      []testBlock
+}
+
+type testBlock struct {
+	index  int
+	bitmap []byte
+	data   []byte
+}
+
+func (v *testDynamicVHD) build(t *testing.T) []byte {
+	t.Helper()
+
+	footer, err := newFixedVHDFooter(v.currentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(footer[16:24], vhdFooterSize)
+	binary.BigEndian.PutUint32(footer[60:64], vhdDynamic)
+	binary.BigEndian.PutUint32(footer[64:68], vhdChecksum(footer))
+
+	tableOffset := int64(vhdFooterSize + vhdHeaderSize)
+	hdr := make([]byte, vhdHeaderSize)
+	copy(hdr[0:8], vhdDynamicCookie)
+	binary.BigEndian.PutUint64(hdr[8:16], vhdNoDataOffset)
+	binary.BigEndian.PutUint64(hdr[16:24], uint64(tableOffset))
+	binary.BigEndian.PutUint32(hdr[24:28], 0x00010000)
+	binary.BigEndian.PutUint32(hdr[28:32], v.entries)
+	binary.BigEndian.PutUint32(hdr[32:36], uint32(v.blockSize))
+
+	bat := make([]byte, roundUp(int64(v.entries)*4, 512))
+	for i := uint32(0); i < v.entries; i++ {
+		binary.BigEndian.PutUint32(bat[i*4:], vhdUnallocated)
+	}
+	bitmapSize := roundUp((v.blockSize/512+7)/8, 512)
+	next := tableOffset + int64(len(bat))
+	var blocks []byte
+	for _, b := range v.blocks {
+		binary.BigEndian.PutUint32(bat[b.index*4:], uint32(next/512))
+		bitmap := make([]byte, bitmapSize)
+		copy(bitmap, b.bitmap)
+		blocks = append(blocks, bitmap...)
+		blocks = append(blocks, b.data...)
+		next += bitmapSize + v.blockSize
+	}
+
+	var file []byte
+	for _, part := range [][]byte{footer, hdr, bat, blocks, footer} {
+		file = append(file, part...)
+	}
+	return file
+}
+
+func TestDynamicDisk(t *testing.T) {
+	const blockSize = 4096
+
+	// garbage in sectors that the bitmap marks absent
+	partial := bytes.Repeat([]byte{0xff}, blockSize)
+	copy(partial, testData(1024))
+	full := testData(blockSize)
+
+	v := &testDynamicVHD{
+		currentSize: 2*blockSize + 3072,
+		blockSize:   blockSize,
+		entries:     3,
+		// the blocks are not in the order of the disk, and the first is
+		// unallocated
+		blocks: []testBlock{
+			{index: 2, bitmap: []byte{0xff}, data: full},
+			{index: 1, bitmap: []byte{0xc0}, data: partial},
+		},
+	}
+	file := v.build(t)
+
+	want := make([]byte, v.currentSize)
+	copy(want[blockSize:], testData(1024))
+	copy(want[2*blockSize:], full[:3072])
+
+	d, err := openDisk(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(*dynamicDisk); !ok {
+		t.Fatalf("opened as %T", d)
+	}
+	if d.maxSize() != v.currentSize {
+		t.Errorf("got max size %d, want %d", d.maxSize(), v.currentSize)
+	}
+
+	got := readDisk(t, d, int64(len(file)))
+	if !bytes.Equal(got, want) {
+		t.Errorf("expanded disk differs from the one written")
+	}
+}
+
+func TestDynamicDiskErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(t *testing.T) []byte
+		want  string
+	}{{
+		name: "block before the table",
+		build: func(t *testing.T) []byte {
+			v := &testDynamicVHD{currentSize: 4096, blockSize: 4096, entries: 1}
+			b := v.build(t)
+			binary.BigEndian.PutUint32(b[vhdFooterSize+vhdHeaderSize:], 1)
+			return b
+		},
+		want: "dynamic VHD blocks must follow the block allocation table",
+	}, {
+		name: "bad block size",
+		build: func(t *testing.T) []byte {
+			v := &testDynamicVHD{currentSize: 4096, blockSize: 1000, entries: 1}
+			return v.build(t)
+		},
+		want: "bad dynamic VHD block size 1000",
+	}, {
+		name: "more table entries than blocks",
+		build: func(t *testing.T) []byte {
+			v := &testDynamicVHD{currentSize: 2*4096 + 1, blockSize: 4096, entries: 3}
+			b := v.build(t)
+			// the table claims far more entries than the file holds
+			binary.BigEndian.PutUint32(b[vhdFooterSize+28:], 0xffffffff)
+			return b
+		},
+		want: "dynamic VHD has 4294967295 table entries for 3 blocks",
+	}, {
+		name: "truncated",
+		build: func(t *testing.T) []byte {
+			v := &testDynamicVHD{
+				currentSize: 4096,
+				blockSize:   4096,
+				entries:     1,
+				blocks:      []testBlock{{index: 0, bitmap: []byte{0xff}, data: testData(4096)}},
+			}
+			b := v.build(t)
+			return b[:len(b)-vhdFooterSize-100]
+		},
+		want: "unexpected end of dynamic VHD",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.build(t)
+			d, err := openDisk(bytes.NewReader(b), int64(len(b)))
+			for err == nil {
+				_, err = d.next()
+			}
+			if err == io.EOF || err.Error() != tt.want {
+				t.Errorf("got error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
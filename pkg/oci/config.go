@@ -0,0 +1,15 @@
+package oci
+
+// Config ...
+type Config struct {
+	TenancyID     string // OCID of the tenancy
+	UserID        string // OCID of the user the API key belongs to
+	Fingerprint   string // Fingerprint of the API key, as shown in the console
+	KeyFile       string // Path to the PEM encoded RSA private key of the API key
+	KeyPassphrase string // Passphrase of the private key, if it is encrypted. Encrypted PKCS #8 keys are not supported.
+	Region        string // Region identifier, e.g. "us-ashburn-1"
+	CompartmentID string // OCID of the compartment images are created in. Defaults to the tenancy.
+	Namespace     string // Object Storage namespace. Looked up if empty.
+	Bucket        string // Existing Object Storage bucket that images are uploaded to
+	UploadWorkers int    // Number of parts uploaded concurrently. Defaults to 4.
+}
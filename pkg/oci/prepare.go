@@ -0,0 +1,310 @@
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sisatech/progress"
+)
+
+// defaultPollInterval is how long to wait between polls of a work request.
+const defaultPollInterval = 15 * time.Second
+
+type imageSourceDetailsStruct struct {
+	SourceType             string `json:"sourceType"`
+	NamespaceName          string `json:"namespaceName"`
+	BucketName             string `json:"bucketName"`
+	ObjectName             string `json:"objectName"`
+	SourceImageType        string `json:"sourceImageType"`
+	OperatingSystem        string `json:"operatingSystem,omitempty"`
+	OperatingSystemVersion string `json:"operatingSystemVersion,omitempty"`
+}
+
+type createImageStruct struct {
+	CompartmentID      string                   `json:"compartmentId"`
+	DisplayName        string                   `json:"displayName"`
+	LaunchMode         string                   `json:"launchMode"`
+	FreeformTags       map[string]string        `json:"freeformTags,omitempty"`
+	ImageSourceDetails imageSourceDetailsStruct `json:"imageSourceDetails"`
+}
+
+type imageStruct struct {
+	ID             string `json:"id"`
+	DisplayName    string `json:"displayName"`
+	LifecycleState string `json:"lifecycleState"`
+}
+
+type workRequestStruct struct {
+	ID              string  `json:"id"`
+	Status          string  `json:"status"`
+	PercentComplete float64 `json:"percentComplete"`
+}
+
+type workRequestErrorStruct struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PrepareOptions holds optional settings for Prepare.
+type PrepareOptions struct {
+	SourceImageType        string            // "QCOW2" or "VMDK". Defaults to "QCOW2".
+	LaunchMode             string            // "NATIVE", "EMULATED", "PARAVIRTUALIZED" or "CUSTOM". Defaults to "PARAVIRTUALIZED".
+	OperatingSystem        string            // Operating system of the image, e.g. "Oracle Linux"
+	OperatingSystemVersion string            // Version of the operating system, e.g. "8"
+	CompartmentID          string            // OCID of the compartment to create the image in. Defaults to Config.CompartmentID.
+	Shapes                 []string          // Shapes, besides the defaults, that the image is marked compatible with
+	FreeformTags           map[string]string // Freeform tags applied to the image
+}
+
+func validatePrepareOptions(p *Provisioner, opts *PrepareOptions) error {
+	switch strings.ToUpper(opts.SourceImageType) {
+	case "":
+		opts.SourceImageType = "QCOW2"
+	case "QCOW2", "VMDK":
+		opts.SourceImageType = strings.ToUpper(opts.SourceImageType)
+	default:
+		return fmt.Errorf("unsupported source image type '%s'", opts.SourceImageType)
+	}
+
+	switch opts.LaunchMode {
+	case "":
+		opts.LaunchMode = "PARAVIRTUALIZED"
+	case "NATIVE", "EMULATED", "PARAVIRTUALIZED", "CUSTOM":
+	default:
+		return fmt.Errorf("unsupported launch mode '%s'", opts.LaunchMode)
+	}
+
+	if opts.CompartmentID == "" {
+		opts.CompartmentID = p.cfg.CompartmentID
+	}
+
+	return nil
+}
+
+// findImage returns the ID of the image called name in compartment, or an
+// empty string if there is none.
+func findImage(p *Provisioner, compartment, name string) (string, error) {
+	_, bodyBytes, err := sendRequest(p, "GET", coreURL(p)+"/images?compartmentId="+url.QueryEscape(compartment)+"&displayName="+url.QueryEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var images []imageStruct
+	err = json.Unmarshal(bodyBytes, &images)
+	if err != nil {
+		return "", err
+	}
+
+	for _, image := range images {
+		if image.DisplayName == name && image.LifecycleState != "DELETED" {
+			return image.ID, nil
+		}
+	}
+
+	return "", nil
+}
+
+func deleteImage(p *Provisioner, id string) error {
+	_, _, err := sendRequest(p, "DELETE", coreURL(p)+"/images/"+id, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func checkImageExists(p *Provisioner, compartment, name string, overwrite bool) error {
+	id, err := findImage(p, compartment, name)
+	if err != nil || id == "" {
+		return err
+	}
+
+	if !overwrite {
+		return fmt.Errorf("image '%s' already exists", name)
+	}
+
+	return deleteImage(p, id)
+}
+
+// createImage starts importing the object objectName as the image name, and
+// returns the ID of the image and of the work request importing it.
+func createImage(p *Provisioner, name, objectName string, opts *PrepareOptions) (string, string, error) {
+	imageData := &createImageStruct{
+		CompartmentID: opts.CompartmentID,
+		DisplayName:   name,
+		LaunchMode:    opts.LaunchMode,
+		FreeformTags:  opts.FreeformTags,
+		ImageSourceDetails: imageSourceDetailsStruct{
+			SourceType:             "objectStorageTuple",
+			NamespaceName:          p.namespace,
+			BucketName:             p.cfg.Bucket,
+			ObjectName:             objectName,
+			SourceImageType:        opts.SourceImageType,
+			OperatingSystem:        opts.OperatingSystem,
+			OperatingSystemVersion: opts.OperatingSystemVersion,
+		},
+	}
+
+	resp, bodyBytes, err := sendRequest(p, "POST", coreURL(p)+"/images", imageData)
+	if err != nil {
+		return "", "", err
+	}
+
+	image := new(imageStruct)
+	err = json.Unmarshal(bodyBytes, image)
+	if err != nil {
+		return "", "", err
+	}
+
+	workRequest := resp.Header.Get("opc-work-request-id")
+	if workRequest == "" {
+		return "", "", errors.New("no work request returned for image " + name)
+	}
+
+	return image.ID, workRequest, nil
+}
+
+// workRequestError returns the errors recorded against a failed work
+// request.
+func workRequestError(p *Provisioner, id, status string) error {
+	err := fmt.Errorf("work request %s %s", id, strings.ToLower(status))
+
+	_, bodyBytes, rerr := sendRequest(p, "GET", coreURL(p)+"/workRequests/"+id+"/errors", nil)
+	if rerr != nil {
+		return err
+	}
+
+	var errs []workRequestErrorStruct
+	if json.Unmarshal(bodyBytes, &errs) != nil || len(errs) == 0 {
+		return err
+	}
+
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Code+": "+e.Message)
+	}
+	return fmt.Errorf("%v: %s", err, strings.Join(msgs, "; "))
+}
+
+// waitForWorkRequest polls a work request until it finishes, reporting its
+// completion to pt.
+func waitForWorkRequest(p *Provisioner, id string, pt progress.ProgressTracker) error {
+	for {
+		_, bodyBytes, err := sendRequest(p, "GET", coreURL(p)+"/workRequests/"+id, nil)
+		if err != nil {
+			return err
+		}
+
+		wr := new(workRequestStruct)
+		err = json.Unmarshal(bodyBytes, wr)
+		if err != nil {
+			return err
+		}
+
+		pt.SetProgress(wr.PercentComplete)
+
+		switch wr.Status {
+		case "SUCCEEDED":
+			return nil
+		case "FAILED", "CANCELED":
+			return workRequestError(p, id, wr.Status)
+		}
+
+		time.Sleep(defaultPollInterval)
+	}
+}
+
+// addShapeCompatibility marks the image id as compatible with shape.
+func addShapeCompatibility(p *Provisioner, id, shape string) error {
+	_, _, err := sendRequest(p, "PUT", coreURL(p)+"/images/"+id+"/shapes/"+url.PathEscape(shape), struct{}{})
+	return err
+}
+
+// Prepare uploads r to the configured bucket and imports it as the custom
+// image name, reporting each stage to pt. The uploaded object is deleted
+// once Prepare finishes, whether or not it succeeds.
+func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool, opts *PrepareOptions, pt progress.ProgressTracker) (err error) {
+
+	o := new(PrepareOptions)
+	if opts != nil {
+		*o = *opts
+	}
+	opts = o
+
+	weights := []progress.StageWeight{
+		{Name: "Checking options.", Weight: 5},
+		{Name: "Uploading image.", Weight: 45},
+		{Name: "Importing image.", Weight: 45},
+	}
+	if len(opts.Shapes) > 0 {
+		weights = append(weights, progress.StageWeight{Name: "Adding shape compatibility.", Weight: 5})
+	}
+	stages := progress.NewWeightedStages(pt, "Provisioning Virtual Machine Image.", weights...)
+	defer func() { stages.Close(err) }()
+
+	ct := stages.Next()
+	ct.Initialize("Checking options.", 2, progress.UnitStep)
+
+	ct.SetStage("Validating options.")
+	err = validatePrepareOptions(p, opts)
+	if err != nil {
+		return err
+	}
+	ct.IncrementProgress(1)
+
+	ct.SetStage("Checking if image already exists.")
+	err = checkImageExists(p, opts.CompartmentID, name, overwriteImage)
+	if err != nil {
+		return err
+	}
+	ct.IncrementProgress(1)
+
+	objectName := name + "." + strings.ToLower(opts.SourceImageType)
+
+	// the object is only needed until the import finishes
+	defer func() {
+		pt.SetStage("Deleting uploaded image.")
+		derr := deleteObject(p, objectName)
+		if err == nil {
+			err = derr
+		}
+	}()
+
+	err = p.ProvisionWithProgress(objectName, r, stages.Next())
+	if err != nil {
+		return err
+	}
+
+	wt := stages.Next()
+	wt.Initialize("Importing image.", 100, progress.UnitPercent)
+	id, workRequest, err := createImage(p, name, objectName, opts)
+	if err != nil {
+		return err
+	}
+
+	err = waitForWorkRequest(p, workRequest, wt)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.Shapes) == 0 {
+		return nil
+	}
+
+	st := stages.Next()
+	st.Initialize("Adding shape compatibility.", float64(len(opts.Shapes)), progress.UnitStep)
+	for _, shape := range opts.Shapes {
+		st.SetStage("Adding compatibility with shape " + shape + ".")
+		err = addShapeCompatibility(p, id, shape)
+		if err != nil {
+			return err
+		}
+		st.IncrementProgress(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
+)
+
+const coreAPIVersion = "20160918"
+
+// Provisioner ...
+type Provisioner struct {
+	cfg       *Config // Config of the provisioner
+	signer    *signer // signs every request with the configured API key
+	namespace string  // Object Storage namespace of the tenancy
+}
+
+// ServiceError is an error returned by an OCI service.
+type ServiceError struct {
+	StatusCode   int    `json:"-"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	OpcRequestID string `json:"-"`
+}
+
+func (e *ServiceError) Error() string {
+	s := fmt.Sprintf("bad status code %d", e.StatusCode)
+	if e.Code != "" {
+		s += ": " + e.Code + ": " + e.Message
+	}
+	if e.OpcRequestID != "" {
+		s += " (request " + e.OpcRequestID + ")"
+	}
+	return s
+}
+
+// HTTPStatus returns the status code of the response.
+func (e *ServiceError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+// isNotFound reports whether err is a service error for a missing resource.
+func isNotFound(err error) bool {
+	e, ok := err.(*ServiceError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+func coreURL(p *Provisioner) string {
+	return "https://iaas." + p.cfg.Region + ".oraclecloud.com/" + coreAPIVersion
+}
+
+func objectStorageURL(p *Provisioner) string {
+	return "https://objectstorage." + p.cfg.Region + ".oraclecloud.com"
+}
+
+// objectURL returns the URL of the object called name in the configured
+// bucket.
+func objectURL(p *Provisioner, name string) string {
+	return objectStorageURL(p) + "/n/" + url.PathEscape(p.namespace) + "/b/" + url.PathEscape(p.cfg.Bucket) + "/o/" + url.PathEscape(name)
+}
+
+// sendRequest sends a signed request with data encoded as JSON, and returns
+// the response along with its body, or a ServiceError if the status is not
+// 2xx.
+func sendRequest(p *Provisioner, verb string, url string, data interface{}) (*http.Response, []byte, error) {
+
+	var body []byte
+	if data != nil {
+		var err error
+		body, err = json.Marshal(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if verb == "POST" || verb == "PUT" {
+		body = []byte{}
+	}
+
+	req, err := http.NewRequest(verb, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	err = p.signer.sign(req, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return doRequest(req)
+}
+
+func doRequest(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := new(ServiceError)
+		json.Unmarshal(bodyBytes, e)
+		e.StatusCode = resp.StatusCode
+		e.OpcRequestID = resp.Header.Get("opc-request-id")
+		return nil, nil, e
+	}
+
+	return resp, bodyBytes, nil
+}
+
+// getNamespace looks up the Object Storage namespace of the tenancy.
+func getNamespace(p *Provisioner) (string, error) {
+	_, bodyBytes, err := sendRequest(p, "GET", objectStorageURL(p)+"/n/", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var namespace string
+	err = json.Unmarshal(bodyBytes, &namespace)
+	if err != nil {
+		return "", err
+	}
+
+	return namespace, nil
+}
+
+// NewProvisioner ...
+func NewProvisioner(cfg *Config) (*Provisioner, error) {
+	p := new(Provisioner)
+
+	c := *cfg
+	if c.Region == "" || c.Bucket == "" {
+		return nil, errors.New("region and bucket are required")
+	}
+	if c.CompartmentID == "" {
+		c.CompartmentID = c.TenancyID
+	}
+	p.cfg = &c
+
+	var err error
+	p.signer, err = newSigner(&c)
+	if err != nil {
+		return nil, err
+	}
+
+	p.namespace = c.Namespace
+	if p.namespace == "" {
+		p.namespace, err = getNamespace(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Provision ...
+func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
+	return p.ProvisionWithProgress(f, r, progress.NewProgressTracker())
+}
+
+// ProvisionWithProgress uploads r as the object f in the configured bucket
+// using a multipart upload, and reports the bytes uploaded to pt.
+func (p *Provisioner) ProvisionWithProgress(f string, r io.ReadCloser, pt progress.ProgressTracker) error {
+
+	size := upload.SourceSize(r)
+	if size < 0 {
+		size = 0
+	}
+	pt.Initialize("Uploading image.", float64(size), progress.UnitBytes)
+	pt.SetStage("Uploading " + f + ".")
+
+	return uploadObject(p, f, r, p.cfg.UploadWorkers, pt)
+}
+
+func deleteObject(p *Provisioner, name string) error {
+	_, _, err := sendRequest(p, "DELETE", objectURL(p, name), nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
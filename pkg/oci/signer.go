@@ -0,0 +1,139 @@
+package oci
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signer signs requests with the HTTP Signature scheme OCI uses for API
+// keys.
+type signer struct {
+	keyID string
+	key   *rsa.PrivateKey
+}
+
+func newSigner(cfg *Config) (*signer, error) {
+	if cfg.TenancyID == "" || cfg.UserID == "" || cfg.Fingerprint == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tenancy, user, fingerprint and key file are required")
+	}
+
+	key, err := loadPrivateKey(cfg.KeyFile, cfg.KeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signer{
+		keyID: cfg.TenancyID + "/" + cfg.UserID + "/" + cfg.Fingerprint,
+		key:   key,
+	}, nil
+}
+
+// loadPrivateKey reads a PEM file holding an RSA private key in PKCS #1 or
+// PKCS #8 form, decrypting it with passphrase if needed. Only the legacy PEM
+// encryption marked by a Proc-Type header, which "openssl genrsa" wrote
+// before OpenSSL 3, is supported: an encrypted PKCS #8 key must be converted
+// first, e.g. with "openssl rsa -traditional -aes128".
+func loadPrivateKey(path, passphrase string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in '%s'", path)
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("key in '%s' is an encrypted PKCS #8 key, which is not supported", path)
+	}
+
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("key in '%s' is encrypted but no passphrase was given", path)
+		}
+		der, err = x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key in '%s' is not an RSA key", path)
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s' in '%s'", block.Type, path)
+}
+
+// sign sets the Date header if it is missing and adds an Authorization
+// header to req. If body is not nil
+// the request's content headers are set from it and included in the
+// signature; uploads to Object Storage pass nil so that their body can be
+// streamed, as the service does not require it to be signed.
+func (s *signer) sign(req *http.Request, body []byte) error {
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	headers := []string{"date", "(request-target)", "host"}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		req.Header.Set("X-Content-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.ContentLength = int64(len(body))
+		headers = append(headers, "content-length", "content-type", "x-content-sha256")
+	}
+
+	var b bytes.Buffer
+	for i, h := range headers {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		switch h {
+		case "(request-target)":
+			b.WriteString(h + ": " + strings.ToLower(req.Method) + " " + req.URL.RequestURI())
+		case "host":
+			b.WriteString(h + ": " + req.URL.Host)
+		default:
+			b.WriteString(h + ": " + req.Header.Get(h))
+		}
+	}
+
+	digest := sha256.Sum256(b.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(`Signature version="1",keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		s.keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+
+	return nil
+}
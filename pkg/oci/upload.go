@@ -0,0 +1,206 @@
+package oci
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
+)
+
+const (
+	partSize       = 32 * 1024 * 1024 // size of every part but the last
+	maxParts       = 10000            // most parts a multipart upload may have
+	defaultWorkers = 4                // concurrent part uploads if Config.UploadWorkers is unset
+	partRetries    = 5                // attempts made for each part before giving up
+	partRetryDelay = 2 * time.Second  // doubled after each failed attempt
+)
+
+type createMultipartUploadStruct struct {
+	Object string `json:"object"`
+}
+
+type multipartUploadStruct struct {
+	UploadID string `json:"uploadId"`
+}
+
+type commitPartStruct struct {
+	PartNum int    `json:"partNum"`
+	Etag    string `json:"etag"`
+}
+
+type commitMultipartUploadStruct struct {
+	PartsToCommit []commitPartStruct `json:"partsToCommit"`
+}
+
+// part is a piece of the object to be uploaded as part number num.
+type part struct {
+	num  int
+	data []byte
+}
+
+// uploadURL returns the URL of the multipart upload uploadID of name.
+func uploadURL(p *Provisioner, name, uploadID string) string {
+	return objectStorageURL(p) + "/n/" + url.PathEscape(p.namespace) + "/b/" + url.PathEscape(p.cfg.Bucket) + "/u/" + url.PathEscape(name) + "?uploadId=" + url.QueryEscape(uploadID)
+}
+
+func createMultipartUpload(p *Provisioner, name string) (string, error) {
+	uploadData := &createMultipartUploadStruct{
+		Object: name,
+	}
+
+	_, bodyBytes, err := sendRequest(p, "POST", objectStorageURL(p)+"/n/"+url.PathEscape(p.namespace)+"/b/"+url.PathEscape(p.cfg.Bucket)+"/u", uploadData)
+	if err != nil {
+		return "", err
+	}
+
+	upload := new(multipartUploadStruct)
+	err = json.Unmarshal(bodyBytes, upload)
+	if err != nil {
+		return "", err
+	}
+
+	return upload.UploadID, nil
+}
+
+// uploadPart uploads one part and returns its ETag. The body of a part is not
+// signed, so it is sent without being hashed.
+func uploadPart(p *Provisioner, name, uploadID string, job part) (string, error) {
+	req, err := http.NewRequest("PUT", uploadURL(p, name, uploadID)+"&uploadPartNum="+strconv.Itoa(job.num), bytes.NewReader(job.data))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(job.data))
+
+	err = p.signer.sign(req, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, _, err := doRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// uploadPartWithRetry uploads job, retrying with exponential backoff on
+// transient failures.
+func uploadPartWithRetry(p *Provisioner, name, uploadID string, job part) (string, error) {
+	var etag string
+	err := upload.Retry(partRetries, partRetryDelay, func() error {
+		var err error
+		etag, err = uploadPart(p, name, uploadID, job)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("uploading part %d: %v", job.num, err)
+	}
+	return etag, nil
+}
+
+func commitMultipartUpload(p *Provisioner, name, uploadID string, etags []string) error {
+	commitData := new(commitMultipartUploadStruct)
+	for i, etag := range etags {
+		commitData.PartsToCommit = append(commitData.PartsToCommit, commitPartStruct{
+			PartNum: i + 1,
+			Etag:    etag,
+		})
+	}
+
+	_, _, err := sendRequest(p, "POST", uploadURL(p, name, uploadID), commitData)
+	return err
+}
+
+func abortMultipartUpload(p *Provisioner, name, uploadID string) error {
+	_, _, err := sendRequest(p, "DELETE", uploadURL(p, name, uploadID), nil)
+	return err
+}
+
+// uploadObject uploads r as the object name using a multipart upload, with
+// parts uploaded by concurrent workers. The upload is aborted if any part
+// fails. Progress is reported to pt in bytes.
+func uploadObject(p *Provisioner, name string, r io.Reader, workers int, pt progress.ProgressTracker) error {
+
+	// a multipart upload cannot be committed with an empty part, so an
+	// empty image is refused before one is created
+	br := bufio.NewReader(r)
+	_, err := br.Peek(1)
+	if err == io.EOF {
+		return errors.New("image is empty")
+	}
+	if err != nil {
+		return err
+	}
+	r = br
+
+	uploadID, err := createMultipartUpload(p, name)
+	if err != nil {
+		return err
+	}
+
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	pool := upload.NewPool(workers, pt)
+
+	var lock sync.Mutex
+	var etags []string
+
+	func() {
+		for num := 1; ; num++ {
+			buf := make([]byte, partSize)
+			n, err := io.ReadFull(r, buf)
+			if err == io.EOF {
+				return
+			}
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				pool.Fail(err)
+				return
+			}
+			if num > maxParts {
+				pool.Fail(fmt.Errorf("image is larger than %d bytes", int64(partSize)*maxParts))
+				return
+			}
+
+			lock.Lock()
+			etags = append(etags, "")
+			lock.Unlock()
+
+			job := part{num: num, data: buf[:n]}
+			ok := pool.Submit(func() (int64, error) {
+				etag, err := uploadPartWithRetry(p, name, uploadID, job)
+				if err != nil {
+					return 0, err
+				}
+				lock.Lock()
+				etags[job.num-1] = etag
+				lock.Unlock()
+				return int64(len(job.data)), nil
+			})
+			if !ok || err != nil {
+				return
+			}
+		}
+	}()
+
+	err = pool.Wait()
+	if err != nil {
+		// the upload error says more than any from aborting
+		abortMultipartUpload(p, name, uploadID)
+		return err
+	}
+
+	return commitMultipartUpload(p, name, uploadID, etags)
+}
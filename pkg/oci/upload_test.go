@@ -0,0 +1,17 @@
+package oci
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sisatech/progress"
+)
+
+func TestUploadObjectEmpty(t *testing.T) {
+	// refused before any request is made, so the provisioner needs no
+	// configuration
+	err := uploadObject(&Provisioner{}, "image", bytes.NewReader(nil), 1, progress.NewProgressTracker())
+	if err == nil || err.Error() != "image is empty" {
+		t.Errorf("got error %v", err)
+	}
+}
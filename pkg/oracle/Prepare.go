@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/sisatech/progress"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -164,7 +165,6 @@ func sendRestRequest(verb string, url string, data interface{}, authCookie strin
 }
 
 func addSSHKeys(p *Provisioner, keyName string) error {
-	fmt.Printf("addSSHKeys...\n")
 	// generate private key
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -183,7 +183,7 @@ func addSSHKeys(p *Provisioner, keyName string) error {
 		Name:    p.user + keyName,
 	}
 
-	resp, err := sendRestRequest("POST", "https://compute.aucom-east-1.oraclecloud.com/sshkey/", sshData, p.authCookie)
+	resp, err := sendRestRequest("POST", p.cfg.EndPoint+"sshkey/", sshData, p.authCookie)
 	if err != nil {
 		return err
 	}
@@ -204,7 +204,7 @@ func createSecurityLists(p *Provisioner, securityListName string) error {
 		Name:               p.user + securityListName,
 	}
 
-	resp, err := sendRestRequest("POST", "https://compute.aucom-east-1.oraclecloud.com/seclist/", securityListsData, p.authCookie)
+	resp, err := sendRestRequest("POST", p.cfg.EndPoint+"seclist/", securityListsData, p.authCookie)
 	if err != nil {
 		return err
 	}
@@ -224,7 +224,7 @@ func reserveIPAddresses(p *Provisioner, ipName string) error {
 		Name:       p.user + ipName,
 	}
 
-	resp, err := sendRestRequest("POST", "https://compute.aucom-east-1.oraclecloud.com/ip/reservation/", ipReservationsData, p.authCookie)
+	resp, err := sendRestRequest("POST", p.cfg.EndPoint+"ip/reservation/", ipReservationsData, p.authCookie)
 	if err != nil {
 		return err
 	}
@@ -438,7 +438,7 @@ func launchOrchestration(p *Provisioner, orchestrationName string, instanceName
 }
 
 func deleteMachineImage(p *Provisioner, machineName string) error {
-	req, err := http.NewRequest("DELETE", "https://compute.aucom-east-1.oraclecloud.com/machineimage/Compute-590079687/joel.smith@sisa-tech.com/"+machineName, nil)
+	req, err := http.NewRequest("DELETE", p.cfg.EndPoint+"machineimage"+p.user+machineName, nil)
 	if err != nil {
 		return err
 	}
@@ -459,7 +459,7 @@ func deleteMachineImage(p *Provisioner, machineName string) error {
 
 func checkMachineImageExists(p *Provisioner, machineName string, overwriteImage bool) error {
 
-	req, err := http.NewRequest("GET", "https://compute.aucom-east-1.oraclecloud.com/machineimage/Compute-590079687/joel.smith@sisa-tech.com/", nil)
+	req, err := http.NewRequest("GET", p.cfg.EndPoint+"machineimage"+p.user, nil)
 	if err != nil {
 		return err
 	}
@@ -499,7 +499,7 @@ func checkMachineImageExists(p *Provisioner, machineName string, overwriteImage
 }
 
 func deleteImageList(p *Provisioner, imageName string) error {
-	req, err := http.NewRequest("DELETE", "https://compute.aucom-east-1.oraclecloud.com/imagelist/Compute-590079687/joel.smith@sisa-tech.com/"+imageName, nil)
+	req, err := http.NewRequest("DELETE", p.cfg.EndPoint+"imagelist"+p.user+imageName, nil)
 	if err != nil {
 		return err
 	}
@@ -520,7 +520,7 @@ func deleteImageList(p *Provisioner, imageName string) error {
 
 func checkImageListExists(p *Provisioner, imageName string, overwriteImage bool) error {
 
-	req, err := http.NewRequest("GET", "https://compute.aucom-east-1.oraclecloud.com/imagelist/Compute-590079687/joel.smith@sisa-tech.com/", nil)
+	req, err := http.NewRequest("GET", p.cfg.EndPoint+"imagelist"+p.user, nil)
 	if err != nil {
 		return err
 	}
@@ -559,20 +559,54 @@ func checkImageListExists(p *Provisioner, imageName string, overwriteImage bool)
 	return nil
 }
 
-// Prepare ...
-func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool) error {
+// Prepare uploads r and creates the image list name from it, reporting each
+// stage to pt. The uploaded object and machine image are deleted once
+// Prepare finishes, along with the image list if it could not be completed.
+func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool, pt progress.ProgressTracker) (err error) {
 
-	err := checkMachineImageExists(p, name, overwriteImage)
+	stages := progress.NewWeightedStages(pt, "Provisioning Virtual Machine Image.",
+		progress.StageWeight{Name: "Checking for existing images.", Weight: 5},
+		progress.StageWeight{Name: "Uploading image.", Weight: 60},
+		progress.StageWeight{Name: "Creating machine image.", Weight: 30},
+		progress.StageWeight{Name: "Creating image list.", Weight: 5},
+	)
+	defer func() { stages.Close(err) }()
+
+	ct := stages.Next()
+	ct.Initialize("Checking for existing images.", 2, progress.UnitStep)
+
+	ct.SetStage("Checking if machine image already exists.")
+	err = checkMachineImageExists(p, name, overwriteImage)
 	if err != nil {
 		return err
 	}
+	ct.IncrementProgress(1)
 
+	ct.SetStage("Checking if image list already exists.")
 	err = checkImageListExists(p, name, overwriteImage)
 	if err != nil {
 		return err
 	}
+	ct.IncrementProgress(1)
+
+	// the object and machine image are only needed to create the image
+	// list, so they are deleted once Prepare finishes
+	var cleanup []func() error
+	defer func() {
+		if len(cleanup) == 0 {
+			return
+		}
+		pt.SetStage("Deleting temporary resources.")
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cerr := cleanup[i]()
+			if err == nil {
+				err = cerr
+			}
+		}
+	}()
 
-	err = p.Provision(name, r)
+	cleanup = append(cleanup, func() error { return deleteObject(p, name) })
+	err = p.ProvisionWithProgress(name, r, stages.Next())
 	if err != nil {
 		return err
 	}
@@ -592,35 +626,48 @@ func (p *Provisioner) Prepare(r io.ReadCloser, name string, overwriteImage bool)
 	// 	return err
 	// }
 
+	mt := stages.Next()
+	mt.Initialize("Creating machine image.", 2, progress.UnitStep)
+	mt.SetStage("Creating machine image.")
 	err = createMachineImage(p, name)
 	if err != nil {
 		return err
 	}
+	cleanup = append(cleanup, func() error { return deleteMachineImage(p, name) })
+	mt.IncrementProgress(1)
 
+	mt.SetStage("Waiting for machine image to become available.")
 	err = waitUntilMachineImageAvailable(p, name)
 	if err != nil {
 		return err
 	}
+	mt.IncrementProgress(1)
 
+	lt := stages.Next()
+	lt.Initialize("Creating image list.", 2, progress.UnitStep)
+	lt.SetStage("Creating image list.")
 	err = createImageList(p, name)
 	if err != nil {
 		return err
 	}
+	lt.IncrementProgress(1)
 
-	err = createImageListEntry(p, name)
-	if err != nil {
-		return err
-	}
-
-	err = deleteObject(name)
-	if err != nil {
-		return err
-	}
+	// an image list without its entry is of no use
+	complete := false
+	cleanup = append(cleanup, func() error {
+		if complete {
+			return nil
+		}
+		return deleteImageList(p, name)
+	})
 
-	err = deleteMachineImage(p, name)
+	lt.SetStage("Creating image list entry.")
+	err = createImageListEntry(p, name)
 	if err != nil {
 		return err
 	}
+	complete = true
+	lt.IncrementProgress(1)
 
 	// err = createBootableStorageVolume(p, volumeName, imageListName)
 	// if err != nil {
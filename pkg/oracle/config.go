@@ -2,8 +2,15 @@ package oracle
 
 // Config ...
 type Config struct {
-	EndPoint        string
-	ServerInstaceID string
-	UserName        string
-	Password        string
+	EndPoint        string // REST endpoint of the Compute site, e.g. "https://compute.uscom-central-1.oraclecloud.com/"
+	ServerInstaceID string // Service instance ID of the Compute identity domain, i.e. the 123456789 in "/Compute-123456789"
+	UserName        string // User name, usually an email address
+	Password        string // Password of the user
+
+	StorageEndPoint  string // Authentication endpoint of Storage Classic. Defaults to "https://<StorageDomain>.storage.oraclecloud.com/auth/v1.0".
+	StorageDomain    string // Identity domain of the storage account, i.e. the example in "Storage-example"
+	StorageUserName  string // Storage user name. Defaults to UserName.
+	StoragePassword  string // Storage password. Defaults to Password.
+	SegmentContainer string // Container that segments of large images are uploaded to. Defaults to "compute_images_segments".
+	UploadWorkers    int    // Number of segments uploaded concurrently. Defaults to 4.
 }
@@ -2,17 +2,26 @@ package oracle
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
 )
 
+// storageContainer is the container images are uploaded to. It is the only
+// container Compute Classic creates machine images from.
+const storageContainer = "compute_images"
+
 // Provisioner ...
 type Provisioner struct {
 	cfg        *Config
 	authCookie string
 	user       string
+	storageURL string // URL of the storage account, returned when authenticating
 }
 
 func sendObjectRequest(verb string, url string, data interface{}, authCookie string) (*http.Response, error) {
@@ -46,7 +55,29 @@ func sendObjectRequest(verb string, url string, data interface{}, authCookie str
 func NewProvisioner(cfg *Config) (*Provisioner, error) {
 	p := new(Provisioner)
 
-	p.cfg = cfg
+	c := *cfg
+	if c.EndPoint == "" {
+		return nil, errors.New("no compute endpoint configured")
+	}
+	if !strings.HasSuffix(c.EndPoint, "/") {
+		c.EndPoint += "/"
+	}
+	if c.StorageEndPoint == "" {
+		if c.StorageDomain == "" {
+			return nil, errors.New("no storage endpoint or storage domain configured")
+		}
+		c.StorageEndPoint = "https://" + c.StorageDomain + ".storage.oraclecloud.com/auth/v1.0"
+	}
+	if c.StorageUserName == "" {
+		c.StorageUserName = c.UserName
+	}
+	if c.StoragePassword == "" {
+		c.StoragePassword = c.Password
+	}
+	if c.SegmentContainer == "" {
+		c.SegmentContainer = storageContainer + "_segments"
+	}
+	p.cfg = &c
 
 	authCookie, err := authenticateCompute(p)
 	if err != nil {
@@ -58,14 +89,21 @@ func NewProvisioner(cfg *Config) (*Provisioner, error) {
 	return p, nil
 }
 
-func authenticateStorage() (string, error) {
+// authenticateStorage returns a token for the storage account, and records
+// the URL of the account in p.
+func authenticateStorage(p *Provisioner) (string, error) {
 
-	req, err := http.NewRequest("GET", "https://sisatech.storage.oraclecloud.com/auth/v1.0", nil)
+	req, err := http.NewRequest("GET", p.cfg.StorageEndPoint, nil)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("X-Storage-User", "Storage-sisatech:joel.smith@sisa-tech.com")
-	req.Header.Set("X-Storage-Pass", "Something1")
+
+	user := p.cfg.StorageUserName
+	if p.cfg.StorageDomain != "" {
+		user = "Storage-" + p.cfg.StorageDomain + ":" + user
+	}
+	req.Header.Set("X-Storage-User", user)
+	req.Header.Set("X-Storage-Pass", p.cfg.StoragePassword)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -73,16 +111,36 @@ func authenticateStorage() (string, error) {
 	}
 	defer resp.Body.Close()
 
-	return resp.Header["X-Storage-Token"][0], nil
+	if resp.StatusCode < 200 || resp.StatusCode > 204 {
+		return "", fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+
+	token := resp.Header.Get("X-Storage-Token")
+	if token == "" {
+		token = resp.Header.Get("X-Auth-Token")
+	}
+	p.storageURL = strings.TrimSuffix(resp.Header.Get("X-Storage-Url"), "/")
+	if token == "" || p.storageURL == "" {
+		return "", errors.New("storage authentication returned no token")
+	}
+
+	return token, nil
+}
+
+// objectURL returns the URL of the uploaded image called name.
+func objectURL(p *Provisioner, name string) string {
+	return p.storageURL + "/" + storageContainer + "/" + name + ".tar.gz"
 }
 
-func deleteObject(onjectName string) error {
-	authCookie, err := authenticateStorage()
+// deleteObject deletes the uploaded image called onjectName. If it is a
+// Static Large Object its segments are deleted along with it.
+func deleteObject(p *Provisioner, onjectName string) error {
+	authCookie, err := authenticateStorage(p)
 	if err != nil {
 		return err
 	}
 
-	resp, err := sendObjectRequest("DELETE", "https://sisatech.storage.oraclecloud.com/v1/Storage-sisatech/compute_images/"+onjectName+".tar.gz", nil, authCookie)
+	resp, err := sendObjectRequest("DELETE", objectURL(p, onjectName)+"?multipart-manifest=delete", nil, authCookie)
 	if err != nil {
 		return err
 	}
@@ -95,31 +153,33 @@ func deleteObject(onjectName string) error {
 
 // Provision ...
 func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
+	return p.ProvisionWithProgress(f, r, progress.NewProgressTracker())
+}
+
+// ProvisionWithProgress uploads r as the object f.tar.gz, replacing any
+// existing object, and reports the bytes uploaded to pt. Images larger than
+// a single segment are uploaded as a Static Large Object, since Storage
+// Classic limits single objects to 5 GB.
+func (p *Provisioner) ProvisionWithProgress(f string, r io.ReadCloser, pt progress.ProgressTracker) error {
 	// fmt.Printf("Provision...\n")
 
 	// delete the object if it already exists
-	err := deleteObject(f)
+	err := deleteObject(p, f)
 	if err != nil && err.Error() != "bad status code 404" {
 		return err
 	}
 
-	authCookie, err := authenticateStorage()
+	authCookie, err := authenticateStorage(p)
 	if err != nil {
 		return err
 	}
 
-	rBytes, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
+	size := upload.SourceSize(r)
+	if size < 0 {
+		size = 0
 	}
+	pt.Initialize("Uploading image.", float64(size), progress.UnitBytes)
+	pt.SetStage("Uploading " + f + ".tar.gz.")
 
-	resp, err := sendObjectRequest("PUT", "https://sisatech.storage.oraclecloud.com/v1/Storage-sisatech/compute_images/"+f+".tar.gz", rBytes, authCookie)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode < 200 || resp.StatusCode > 204 {
-		return fmt.Errorf("bad status code %d", resp.StatusCode)
-	}
-
-	return nil
+	return uploadObject(p, authCookie, f, r, p.cfg.UploadWorkers, pt)
 }
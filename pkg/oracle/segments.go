@@ -0,0 +1,219 @@
+package oracle
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
+)
+
+const (
+	segmentSize       = 128 * 1024 * 1024 // size of every segment but the last
+	maxSegments       = 1000              // most segments a manifest may list
+	defaultWorkers    = 4                 // concurrent segment uploads if Config.UploadWorkers is unset
+	segmentRetries    = 5                 // attempts made for each segment before giving up
+	segmentRetryDelay = 2 * time.Second   // doubled after each failed attempt
+)
+
+// manifestEntryStruct describes one segment of a Static Large Object.
+type manifestEntryStruct struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int    `json:"size_bytes"`
+}
+
+// segment is a piece of the image to be uploaded as the index'th segment.
+type segment struct {
+	index int
+	data  []byte
+}
+
+// putObject uploads data to url. The MD5 of data is sent as its ETag so that
+// the service verifies it, and is returned.
+func putObject(url string, data []byte, authCookie string) (string, error) {
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Auth-Token", authCookie)
+	req.Header.Set("ETag", etag)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", &upload.StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return etag, nil
+}
+
+// putObjectWithRetry uploads data to url, retrying with exponential backoff
+// on transient failures.
+func putObjectWithRetry(url string, data []byte, authCookie string) (string, error) {
+	var etag string
+	err := upload.Retry(segmentRetries, segmentRetryDelay, func() error {
+		var err error
+		etag, err = putObject(url, data, authCookie)
+		return err
+	})
+	return etag, err
+}
+
+// createSegmentContainer creates the segment container, succeeding if it
+// already exists.
+func createSegmentContainer(p *Provisioner, authCookie string) error {
+	resp, err := sendObjectRequest("PUT", p.storageURL+"/"+p.cfg.SegmentContainer, nil, authCookie)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// putManifest creates the object name as a Static Large Object made of
+// segments.
+func putManifest(p *Provisioner, name string, segments []manifestEntryStruct, authCookie string) error {
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sendObjectRequest("PUT", objectURL(p, name)+"?multipart-manifest=put", manifest, authCookie)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// deleteSegments removes segments uploaded before an upload failed.
+func deleteSegments(p *Provisioner, segments []manifestEntryStruct, authCookie string) {
+	for _, s := range segments {
+		if s.Etag == "" {
+			continue
+		}
+		sendObjectRequest("DELETE", p.storageURL+s.Path, nil, authCookie)
+	}
+}
+
+// uploadObject uploads r as the object name.tar.gz. If r holds no more than
+// one segment it is uploaded as a single object; otherwise its segments are
+// uploaded to the segment container by concurrent workers and joined by a
+// Static Large Object manifest. Progress is reported to pt in bytes.
+func uploadObject(p *Provisioner, authCookie string, name string, r io.Reader, workers int, pt progress.ProgressTracker) error {
+
+	first := make([]byte, segmentSize)
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = putObjectWithRetry(objectURL(p, name), first[:n], authCookie)
+		if err != nil {
+			return err
+		}
+		pt.IncrementProgress(float64(n))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = createSegmentContainer(p, authCookie)
+	if err != nil {
+		return err
+	}
+
+	// segments of each upload get their own prefix so that they never
+	// collide with those of an earlier upload of the same name
+	prefix := "/" + p.cfg.SegmentContainer + "/" + name + ".tar.gz/" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/"
+
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	pool := upload.NewPool(workers, pt)
+
+	var lock sync.Mutex
+	var segments []manifestEntryStruct
+
+	func() {
+		data := first
+		for i := 0; ; i++ {
+			if i == maxSegments {
+				pool.Fail(fmt.Errorf("image is larger than %d bytes", int64(segmentSize)*maxSegments))
+				return
+			}
+
+			lock.Lock()
+			segments = append(segments, manifestEntryStruct{
+				Path:      prefix + fmt.Sprintf("%08d", i+1),
+				SizeBytes: len(data),
+			})
+			path := segments[i].Path
+			lock.Unlock()
+
+			job := segment{index: i, data: data}
+			ok := pool.Submit(func() (int64, error) {
+				etag, err := putObjectWithRetry(p.storageURL+path, job.data, authCookie)
+				if err != nil {
+					return 0, fmt.Errorf("uploading segment %d: %v", job.index+1, err)
+				}
+
+				lock.Lock()
+				segments[job.index].Etag = etag
+				lock.Unlock()
+				return int64(len(job.data)), nil
+			})
+			if !ok {
+				return
+			}
+
+			data = make([]byte, segmentSize)
+			n, err := io.ReadFull(r, data)
+			if err == io.EOF {
+				return
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				pool.Fail(err)
+				return
+			}
+			data = data[:n]
+		}
+	}()
+
+	err = pool.Wait()
+	if err != nil {
+		deleteSegments(p, segments, authCookie)
+		return err
+	}
+
+	err = putManifest(p, name, segments, authCookie)
+	if err != nil {
+		deleteSegments(p, segments, authCookie)
+		return err
+	}
+
+	return nil
+}
@@ -8,4 +8,20 @@ type Config struct {
 	Datacenter   string
 	Datastore    string
 	ResourcePool string
+	Folder       string // Inventory path of the VM folder templates are created in. Defaults to the datacenter's VM folder.
+	Cluster      string // Cluster to import into. Its root resource pool is used unless ResourcePool is set.
+	Host         string // Host to import onto. Must belong to Cluster if both are set.
+
+	Insecure    bool              // Skip verification of certificates entirely. Only for testing.
+	CAFile      string            // Path to a PEM bundle of CA certificates trusted in addition to the system's
+	Thumbprints map[string]string // Pinned SHA-1 or SHA-256 certificate thumbprints, keyed by host or host:port
+
+	NetworkMapping     map[string]string // Maps network names in the OVF descriptor to the inventory path of a network or port group
+	DiskProvisioning   string            // "thin", "thick" or "eagerZeroedThick". Defaults to "thin".
+	IPAllocationPolicy string            // "dhcp", "transient", "fixed" or "fixedAllocated". Defaults to "dhcp".
+	IPProtocol         string            // "IPv4" or "IPv6". Defaults to "IPv4".
+	Properties         map[string]string // Values of OVF properties, keyed by property ID, e.g. "guestinfo.hostname"
+
+	ContentLibrary string // Name of a local content library to also publish templates to as OVF items. Optional.
+	Annotation     string // Notes set on the VM in place of marking it as a template when Address is a standalone ESXi host
 }
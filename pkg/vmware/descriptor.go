@@ -0,0 +1,219 @@
+package vmware
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"text/template"
+)
+
+// VMOptions describes the virtual machine built around a raw disk.
+type VMOptions struct {
+	CPUs            int    // Number of virtual CPUs. Defaults to 1.
+	MemoryMB        int    // Memory in MiB. Defaults to 1024.
+	Firmware        string // "bios" or "efi". Defaults to "bios".
+	HardwareVersion int    // Virtual hardware version, e.g. 13. Defaults to 10.
+	NICType         string // "vmxnet3", "e1000" or "e1000e". Defaults to "vmxnet3".
+	DiskController  string // "lsilogic", "lsilogicsas", "pvscsi", "buslogic" or "ide". Defaults to "lsilogic".
+	GuestOSID       string // vSphere guest OS identifier. Defaults to "otherLinux64Guest".
+	Network         string // Network the NIC is connected to. Defaults to "VM Network".
+	DiskSize        int64  // Size of the raw disk in bytes. Needed if it cannot be determined from the input.
+}
+
+// nicSubTypes maps NIC types to their OVF resource subtypes.
+var nicSubTypes = map[string]string{
+	"vmxnet3": "VmxNet3",
+	"e1000":   "E1000",
+	"e1000e":  "E1000e",
+}
+
+// controllerSubTypes maps SCSI controller types to their OVF resource
+// subtypes.
+var controllerSubTypes = map[string]string{
+	"lsilogic":    "lsilogic",
+	"lsilogicsas": "lsilogicsas",
+	"pvscsi":      "VirtualSCSI",
+	"buslogic":    "buslogic",
+}
+
+// validateVMOptions checks opts and fills in its defaults.
+func validateVMOptions(opts *VMOptions) error {
+	if opts.CPUs == 0 {
+		opts.CPUs = 1
+	}
+	if opts.MemoryMB == 0 {
+		opts.MemoryMB = 1024
+	}
+	if opts.CPUs < 0 || opts.MemoryMB < 0 {
+		return fmt.Errorf("CPU count and memory must be positive")
+	}
+
+	switch opts.Firmware {
+	case "":
+		opts.Firmware = "bios"
+	case "bios", "efi":
+	default:
+		return fmt.Errorf("unsupported firmware '%s'", opts.Firmware)
+	}
+
+	if opts.HardwareVersion == 0 {
+		opts.HardwareVersion = 10
+	}
+	if opts.HardwareVersion < 4 {
+		return fmt.Errorf("unsupported hardware version %d", opts.HardwareVersion)
+	}
+
+	if opts.NICType == "" {
+		opts.NICType = "vmxnet3"
+	}
+	if _, ok := nicSubTypes[opts.NICType]; !ok {
+		return fmt.Errorf("unsupported NIC type '%s'", opts.NICType)
+	}
+
+	if opts.DiskController == "" {
+		opts.DiskController = "lsilogic"
+	}
+	if _, ok := controllerSubTypes[opts.DiskController]; !ok && opts.DiskController != "ide" {
+		return fmt.Errorf("unsupported disk controller '%s'", opts.DiskController)
+	}
+
+	if opts.GuestOSID == "" {
+		opts.GuestOSID = "otherLinux64Guest"
+	}
+	if opts.Network == "" {
+		opts.Network = "VM Network"
+	}
+
+	return nil
+}
+
+// vmdkAdapterType returns the adapter type recorded in the VMDK descriptor
+// for a disk controller.
+func vmdkAdapterType(controller string) string {
+	switch controller {
+	case "ide", "buslogic":
+		return controller
+	}
+	return "lsilogic"
+}
+
+var ovfTemplate = template.Must(template.New("ovf").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var b bytes.Buffer
+		err := xml.EscapeText(&b, []byte(s))
+		return b.String(), err
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="disk.vmdk" ovf:id="file1" ovf:size="{{.Capacity}}"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="{{.Capacity}}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="{{xml .Opts.Network}}">
+      <Description>The {{xml .Opts.Network}} network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{xml .Name}}">
+    <Info>A virtual machine</Info>
+    <Name>{{xml .Name}}</Name>
+    <OperatingSystemSection ovf:id="1" vmw:osType="{{xml .Opts.GuestOSID}}">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{xml .Name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-{{printf "%02d" .Opts.HardwareVersion}}</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{.Opts.CPUs}} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.Opts.CPUs}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{.Opts.MemoryMB}}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.Opts.MemoryMB}}</rasd:VirtualQuantity>
+      </Item>
+{{- if .ControllerSubType}}
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>{{.ControllerSubType}}</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+{{- else}}
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>IDE Controller</rasd:Description>
+        <rasd:ElementName>IDE controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceType>5</rasd:ResourceType>
+      </Item>
+{{- end}}
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>7</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>{{xml .Opts.Network}}</rasd:Connection>
+        <rasd:Description>{{.NICSubType}} ethernet adapter on {{xml .Opts.Network}}</rasd:Description>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>{{.NICSubType}}</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="{{.Opts.Firmware}}"/>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+// ovfDescriptor returns an OVF descriptor for a virtual machine called name
+// with a single stream-optimized disk, disk.vmdk, of capacity bytes. opts
+// must have been validated. The converted disk is not known until it has
+// been uploaded, so its size is given as the capacity: the lease updater
+// measures the progress it reports to vCenter, which keeps the lease alive,
+// against the sizes of the files.
+func ovfDescriptor(name string, capacity int64, opts *VMOptions) (string, error) {
+	var b bytes.Buffer
+	err := ovfTemplate.Execute(&b, struct {
+		Name              string
+		Capacity          int64
+		Opts              *VMOptions
+		ControllerSubType string
+		NICSubType        string
+	}{
+		Name:              name,
+		Capacity:          capacity,
+		Opts:              opts,
+		ControllerSubType: controllerSubTypes[opts.DiskController],
+		NICSubType:        nicSubTypes[opts.NICType],
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,46 @@
+package vmware
+
+import (
+	"errors"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// defaultAnnotation marks a virtual machine imported directly to an ESXi
+// host as an image rather than a machine to run.
+const defaultAnnotation = "Imported base image. Copy it or register it elsewhere before changing it."
+
+// validateESXi checks that the Config asks for nothing a standalone ESXi
+// host cannot provide. Templates, clusters and content libraries all need
+// vCenter.
+func validateESXi(p *Provisioner) error {
+	if p.cfg.Cluster != "" {
+		return errors.New("clusters are not available on a standalone ESXi host")
+	}
+	if p.cfg.ContentLibrary != "" {
+		return errors.New("content libraries are not available on a standalone ESXi host")
+	}
+
+	return nil
+}
+
+// annotateVM stands in for marking vm as a template on a standalone ESXi
+// host, which does not support templates. The virtual machine is left
+// registered and powered off, with an annotation that identifies it as an
+// image.
+func annotateVM(p *Provisioner, vm *object.VirtualMachine) error {
+	annotation := p.cfg.Annotation
+	if annotation == "" {
+		annotation = defaultAnnotation
+	}
+
+	task, err := vm.Reconfigure(p.ctx, types.VirtualMachineConfigSpec{
+		Annotation: annotation,
+	})
+	if err != nil {
+		return err
+	}
+
+	return task.Wait(p.ctx)
+}
@@ -0,0 +1,200 @@
+package vmware
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+)
+
+type libraryFindSpecStruct struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type libraryItemFindSpecStruct struct {
+	LibraryID string `json:"library_id"`
+	Name      string `json:"name"`
+}
+
+type libraryItemStruct struct {
+	ID             string `json:"id,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Description    string `json:"description,omitempty"`
+	ContentVersion string `json:"content_version,omitempty"`
+}
+
+type ovfSourceStruct struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type ovfTargetStruct struct {
+	LibraryID     string `json:"library_id,omitempty"`
+	LibraryItemID string `json:"library_item_id,omitempty"`
+}
+
+type ovfCreateSpecStruct struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type ovfCreateStruct struct {
+	Source     ovfSourceStruct     `json:"source"`
+	Target     ovfTargetStruct     `json:"target"`
+	CreateSpec ovfCreateSpecStruct `json:"create_spec"`
+}
+
+type ovfCreateResultStruct struct {
+	Succeeded        bool   `json:"succeeded"`
+	OvfLibraryItemID string `json:"ovf_library_item_id"`
+	Error            *struct {
+		Errors []struct {
+			Category string `json:"category"`
+			Error    struct {
+				Messages []vapiMessageStruct `json:"messages"`
+			} `json:"error"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// findLibrary returns the ID of the local content library name.
+func findLibrary(s *vapiSession, name string) (string, error) {
+	var ids []string
+	err := s.request("POST", "/com/vmware/content/library?~action=find", map[string]interface{}{
+		"spec": libraryFindSpecStruct{
+			Name: name,
+			Type: "LOCAL",
+		},
+	}, &ids)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ids) == 0 {
+		return "", fmt.Errorf("local content library '%s' not found", name)
+	}
+
+	return ids[0], nil
+}
+
+// findLibraryItem returns the ID of the item name in a library, or an empty
+// string if there is no such item.
+func findLibraryItem(s *vapiSession, libraryID, name string) (string, error) {
+	var ids []string
+	err := s.request("POST", "/com/vmware/content/library/item?~action=find", map[string]interface{}{
+		"spec": libraryItemFindSpecStruct{
+			LibraryID: libraryID,
+			Name:      name,
+		},
+	}, &ids)
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+
+	return ids[0], nil
+}
+
+func getLibraryItem(s *vapiSession, id string) (*libraryItemStruct, error) {
+	item := new(libraryItemStruct)
+	err := s.request("GET", "/com/vmware/content/library/item/id:"+id, nil, item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func setLibraryItemDescription(s *vapiSession, id, description string) error {
+	return s.request("PATCH", "/com/vmware/content/library/item/id:"+id, map[string]interface{}{
+		"update_spec": libraryItemStruct{
+			Description: description,
+		},
+	}, nil)
+}
+
+// captureVM exports vm as an OVF template into the library item target,
+// which either names an existing item to be updated or a library to create
+// the item name in.
+func captureVM(s *vapiSession, vm *object.VirtualMachine, name string, target ovfTargetStruct) (string, error) {
+	result := new(ovfCreateResultStruct)
+	err := s.request("POST", "/com/vmware/vcenter/ovf/library-item", &ovfCreateStruct{
+		Source: ovfSourceStruct{
+			Type: "VirtualMachine",
+			ID:   vm.Reference().Value,
+		},
+		Target: target,
+		CreateSpec: ovfCreateSpecStruct{
+			Name: name,
+		},
+	}, result)
+	if err != nil {
+		return "", err
+	}
+
+	if !result.Succeeded {
+		if result.Error != nil {
+			for _, e := range result.Error.Errors {
+				if len(e.Error.Messages) > 0 {
+					return "", errors.New(e.Error.Messages[0].DefaultMessage)
+				}
+			}
+		}
+		return "", fmt.Errorf("capturing '%s' into content library failed", name)
+	}
+
+	return result.OvfLibraryItemID, nil
+}
+
+// publishToLibrary captures vm as the OVF template name in the configured
+// content library, replacing the content of an existing item of that name.
+// Each publication bumps the content version of the item, which subscribed
+// libraries use to decide when to synchronise; the description of the item
+// records the version and when it was published.
+func publishToLibrary(p *Provisioner, vm *object.VirtualMachine, name string) (err error) {
+
+	s, err := newVAPISession(p)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := s.close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	libraryID, err := findLibrary(s, p.cfg.ContentLibrary)
+	if err != nil {
+		return err
+	}
+
+	itemID, err := findLibraryItem(s, libraryID, name)
+	if err != nil {
+		return err
+	}
+
+	target := ovfTargetStruct{LibraryID: libraryID}
+	if itemID != "" {
+		target = ovfTargetStruct{LibraryItemID: itemID}
+	}
+
+	itemID, err = captureVM(s, vm, name, target)
+	if err != nil {
+		return err
+	}
+
+	item, err := getLibraryItem(s, itemID)
+	if err != nil {
+		return err
+	}
+
+	version, err := strconv.Atoi(item.ContentVersion)
+	if err != nil {
+		version = 1
+	}
+
+	return setLibraryItemDescription(s, itemID, fmt.Sprintf("%s version %d, published %s", name, version, time.Now().UTC().Format(time.RFC3339)))
+}
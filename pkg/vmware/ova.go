@@ -0,0 +1,218 @@
+package vmware
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sisatech/progress"
+	"github.com/vmware/govmomi/nfc"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// tarMagicOffset is where the magic of a POSIX tar header is found.
+const tarMagicOffset = 257
+
+// isOVA reports whether r starts with a tar header, without consuming it.
+func isOVA(r *bufio.Reader) bool {
+	b, err := r.Peek(tarMagicOffset + 5)
+	return err == nil && string(b[tarMagicOffset:]) == "ustar"
+}
+
+// createImportSpec asks vCenter for an import spec of the OVF descriptor,
+// to be imported as a virtual machine called name. Any warnings about the
+// descriptor are added to res.
+func createImportSpec(p *Provisioner, name, descriptor string, res *Result) (*types.OvfCreateImportSpecResult, error) {
+	importParams, err := importSpecParams(p, name, descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	ovfManager := ovf.NewManager(p.vclient.Client)
+	cis, err := ovfManager.CreateImportSpec(p.ctx, descriptor, p.vsphere.resourcepool, p.vsphere.datastore, importParams)
+	if err != nil {
+		return nil, err
+	}
+	if cis.Error != nil {
+		return nil, fmt.Errorf("%s", cis.Error[0].LocalizedMessage)
+	}
+	for _, w := range cis.Warning {
+		res.Warnings = append(res.Warnings, newWarning(w))
+	}
+
+	return cis, nil
+}
+
+// uploadOVAFiles streams the remaining entries of an OVA to the lease,
+// matching each to a file of the import by its path. Entries that the import
+// does not need, such as the manifest, are skipped. The progress of each file
+// is reported to a subtracker of pt.
+func uploadOVAFiles(p *Provisioner, lease *nfc.Lease, items []nfc.FileItem, tr *tar.Reader, pt progress.ProgressTracker) error {
+	pending := make(map[string]nfc.FileItem)
+	var total int64
+	for _, item := range items {
+		pending[path.Clean(item.Path)] = item
+		total += item.Size
+	}
+
+	pt.Initialize("Uploading files.", float64(total), progress.UnitBytes)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		item, ok := pending[path.Clean(hdr.Name)]
+		if !ok {
+			continue
+		}
+		delete(pending, path.Clean(hdr.Name))
+
+		fp := newFileProgress(pt, item, tr, hdr.Size)
+		err = lease.Upload(p.ctx, item, fp, soap.Upload{
+			ContentLength: hdr.Size,
+		})
+		fp.done(err)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %v", hdr.Name, err)
+		}
+	}
+
+	if len(pending) > 0 {
+		var missing []string
+		for name := range pending {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("OVA is missing %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// importVApp imports the OVF descriptor as the virtual machine name, calling
+// upload to send the files the import needs to the lease, with the upload
+// stage of stages for their progress. The lease is aborted if upload fails.
+func importVApp(p *Provisioner, name, descriptor string, res *Result, stages *progress.WeightedStages, upload func(*nfc.Lease, []nfc.FileItem, progress.ProgressTracker) error) (*object.VirtualMachine, error) {
+
+	st := stages.Next()
+	st.Initialize("Preparing import.", 2, progress.UnitStep)
+
+	st.SetStage("Creating import spec.")
+	cis, err := createImportSpec(p, name, descriptor, res)
+	if err != nil {
+		return nil, err
+	}
+	st.IncrementProgress(1)
+
+	st.SetStage("Waiting for lease.")
+
+	lease, err := p.vsphere.resourcepool.ImportVApp(p.ctx, cis.ImportSpec, p.vsphere.folder, p.vsphere.host)
+	if err != nil {
+		return nil, err
+	}
+
+	inf, err := lease.Wait(p.ctx, cis.FileItem)
+	if err != nil {
+		return nil, err
+	}
+
+	st.IncrementProgress(1)
+
+	updater := lease.StartUpdater(p.ctx, inf)
+	err = upload(lease, inf.Items, stages.Next())
+	updater.Done()
+	if err != nil {
+		lease.Abort(p.ctx, &types.LocalizedMethodFault{
+			LocalizedMessage: err.Error(),
+		})
+		return nil, err
+	}
+
+	err = lease.Complete(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if inf.Entity.Value == "" {
+		return nil, errors.New("import did not create a virtual machine")
+	}
+
+	return object.NewVirtualMachine(p.vclient.Client, inf.Entity), nil
+}
+
+// importOVA imports the OVA read from r as the virtual machine name. The OVF
+// descriptor must be the first entry of the archive, as the OVF
+// specification requires, so that each disk can be uploaded as it is read.
+func importOVA(p *Provisioner, name string, r io.Reader, res *Result, stages *progress.WeightedStages) (*object.VirtualMachine, error) {
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(hdr.Name), ".ovf") {
+		return nil, fmt.Errorf("first entry of the OVA is %s rather than an OVF descriptor", hdr.Name)
+	}
+
+	descriptor, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	return importVApp(p, name, string(descriptor), res, stages, func(lease *nfc.Lease, items []nfc.FileItem, lt progress.ProgressTracker) error {
+		return uploadOVAFiles(p, lease, items, tr, lt)
+	})
+}
+
+// importRaw converts the raw disk read from r, of size bytes, into a
+// stream-optimized VMDK and imports it as the virtual machine name described
+// by opts. The disk is converted as it is uploaded, and its progress is
+// reported in bytes of the raw disk consumed.
+func importRaw(p *Provisioner, name string, r io.Reader, size int64, opts *VMOptions, res *Result, stages *progress.WeightedStages) (*object.VirtualMachine, error) {
+
+	capacity := (size + sectorSize - 1) / sectorSize * sectorSize
+	descriptor, err := ovfDescriptor(name, capacity, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return importVApp(p, name, descriptor, res, stages, func(lease *nfc.Lease, items []nfc.FileItem, lt progress.ProgressTracker) error {
+		if len(items) != 1 {
+			return fmt.Errorf("import expects %d files rather than a single disk", len(items))
+		}
+
+		lt.Initialize("Uploading files.", float64(size), progress.UnitBytes)
+		fp := newFileProgress(lt, items[0], r, size)
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeStreamOptimized(pw, fp, size, vmdkAdapterType(opts.DiskController)))
+		}()
+
+		// the length of the converted disk is unknown, so it is sent chunked,
+		// with the request lease.Upload would make for a disk but the
+		// progress measured against the raw disk
+		err := p.vclient.Client.Upload(p.ctx, pr, items[0].URL, &soap.Upload{
+			Method:   "POST",
+			Type:     "application/x-vnd.vmware-streamVmdk",
+			Progress: fp.sink(items[0]),
+		})
+		pr.CloseWithError(errors.New("upload finished"))
+		fp.done(err)
+		return err
+	})
+}
@@ -0,0 +1,306 @@
+package vmware
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sisatech/progress"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+  <References>
+    <File ovf:href="disk1.vmdk" ovf:id="file1" ovf:size="1000"/>
+    <File ovf:href="disk2.vmdk" ovf:id="file2" ovf:size="3000"/>
+  </References>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="VM Network"/>
+  </NetworkSection>
+  <VirtualSystem ovf:id="test">
+    <Info>A virtual machine</Info>
+    <ProductSection>
+      <Info>Properties</Info>
+      <Property ovf:key="guestinfo.hostname" ovf:type="string"/>
+    </ProductSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+// testOVAFile is an entry of an OVA.
+type testOVAFile struct {
+	name string
+	data []byte
+}
+
+// testOVAFiles are the entries of an OVA of testOVF.
+var testOVAFiles = []testOVAFile{
+	{"test.ovf", []byte(testOVF)},
+	{"test.mf", []byte("SHA256(disk1.vmdk)= 0\n")},
+	{"disk1.vmdk", bytes.Repeat([]byte{1}, 1000)},
+	{"disk2.vmdk", bytes.Repeat([]byte{2}, 3000)},
+}
+
+// newTestOVA returns an OVA of files.
+func newTestOVA(t *testing.T, files []testOVAFile) io.ReadCloser {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name: f.name,
+			Mode: 0644,
+			Size: int64(len(f.data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(f.data)
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ioutil.NopCloser(&b)
+}
+
+// newTestProvisioner returns a Provisioner that imports into the cluster of
+// sim, and closes it when the test finishes.
+func newTestProvisioner(t *testing.T, sim *testSimulator) *Provisioner {
+	cfg := sim.config()
+	cfg.Cluster = "DC0_C0"
+	p, err := NewProvisioner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// importedVM returns the virtual machine created by the last import.
+func importedVM(t *testing.T, sim *testSimulator) *simulator.VirtualMachine {
+	lease := sim.lastLease()
+	if lease == nil {
+		t.Fatal("nothing imported")
+	}
+	return simulator.Map.Get(lease.Info.Entity).(*simulator.VirtualMachine)
+}
+
+func TestImportOVA(t *testing.T) {
+	sim := newTestSimulator(t, simulator.VPX())
+	p := newTestProvisioner(t, sim)
+	p.cfg.NetworkMapping = map[string]string{"VM Network": "DC0_DVPG0"}
+	p.cfg.Properties = map[string]string{"guestinfo.hostname": "test"}
+	err := resolvePlacement(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt := progress.NewProgressTracker()
+	res, err := p.ProvisionWithProgress("ova", newTestOVA(t, testOVAFiles), pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 0 {
+		t.Errorf("got warnings %v", res.Warnings)
+	}
+
+	for _, f := range testOVAFiles[2:] {
+		if got := sim.upload(f.name); !bytes.Equal(got, f.data) {
+			t.Errorf("got %d bytes of %s, want %d", len(got), f.name, len(f.data))
+		}
+	}
+	if got := sim.upload("test.mf"); got != nil {
+		t.Error("manifest uploaded")
+	}
+
+	params := sim.ovf.params
+	if params.EntityName != "ova" || params.DiskProvisioning != "thin" {
+		t.Errorf("got import spec params %+v", params)
+	}
+	wantNetworks := []types.OvfNetworkMapping{{Name: "VM Network", Network: p.vsphere.networks["VM Network"]}}
+	if !reflect.DeepEqual(params.NetworkMapping, wantNetworks) {
+		t.Errorf("got network mapping %+v, want %+v", params.NetworkMapping, wantNetworks)
+	}
+	wantProperties := []types.KeyValue{{Key: "guestinfo.hostname", Value: "test"}}
+	if !reflect.DeepEqual(params.PropertyMapping, wantProperties) {
+		t.Errorf("got property mapping %+v, want %+v", params.PropertyMapping, wantProperties)
+	}
+
+	status := pt.Status()
+	if status.Fraction != 1 {
+		t.Errorf("got fraction %v", status.Fraction)
+	}
+	if len(status.Subtasks) != 3 {
+		t.Fatalf("got %d subtasks, want one for each stage", len(status.Subtasks))
+	}
+	for _, sub := range status.Subtasks {
+		if !sub.Finished || sub.Weight == 0 {
+			t.Errorf("got stage %q finished %v with weight %v", sub.Operation, sub.Finished, sub.Weight)
+		}
+	}
+	upload := status.Subtasks[1]
+	if upload.Total != 4000 || upload.Progress != 4000 || len(upload.Subtasks) != 2 {
+		t.Errorf("got upload of %v/%v bytes in %d files, want 4000 bytes in 2", upload.Progress, upload.Total, len(upload.Subtasks))
+	}
+
+	if lease := sim.lastLease(); lease.State != types.HttpNfcLeaseStateDone {
+		t.Errorf("lease left %s", lease.State)
+	}
+}
+
+func TestImportOVAMissingDisk(t *testing.T) {
+	sim := newTestSimulator(t, simulator.VPX())
+	p := newTestProvisioner(t, sim)
+
+	err := p.Provision("ova", newTestOVA(t, testOVAFiles[:3]))
+	if err == nil || err.Error() != "OVA is missing disk2.vmdk" {
+		t.Fatalf("got error %v", err)
+	}
+
+	fault := sim.lastLease().abortFault()
+	if fault == nil || fault.LocalizedMessage != err.Error() {
+		t.Errorf("lease aborted with %+v", fault)
+	}
+	if importedVM(t, sim).Config.Template {
+		t.Error("failed import marked as a template")
+	}
+}
+
+func TestImportOVAOutOfOrder(t *testing.T) {
+	sim := newTestSimulator(t, simulator.VPX())
+	p := newTestProvisioner(t, sim)
+
+	files := []testOVAFile{testOVAFiles[2], testOVAFiles[0]}
+	err := p.Provision("ova", newTestOVA(t, files))
+	if err == nil || !strings.Contains(err.Error(), "rather than an OVF descriptor") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestCreateImportSpec(t *testing.T) {
+	tests := []struct {
+		name       string
+		descriptor string
+		networks   map[string]string // Config.NetworkMapping
+		warning    []types.LocalizedMethodFault
+		error      []types.LocalizedMethodFault
+		warnings   []Warning
+		err        string
+	}{{
+		name:       "clean",
+		descriptor: testOVF,
+		networks:   map[string]string{"VM Network": "DC0_DVPG0"},
+	}, {
+		name:       "warnings",
+		descriptor: testOVF,
+		warning: []types.LocalizedMethodFault{{
+			Fault:            &types.OvfUnsupportedSection{},
+			LocalizedMessage: "Unsupported section ignored",
+		}, {
+			LocalizedMessage: "Something else",
+		}},
+		warnings: []Warning{
+			{Fault: "OvfUnsupportedSection", Message: "Unsupported section ignored"},
+			{Message: "Something else"},
+		},
+	}, {
+		name:       "errors",
+		descriptor: testOVF,
+		error: []types.LocalizedMethodFault{{
+			Fault:            &types.OvfNoHostNic{},
+			LocalizedMessage: "No host NIC",
+		}},
+		err: "No host NIC",
+	}, {
+		name:       "fault",
+		descriptor: "not a descriptor",
+		err:        "ServerFaultCode: EOF",
+	}, {
+		name:       "unknown network",
+		descriptor: strings.Replace(testOVF, "VM Network", "Other Network", 1),
+		networks:   map[string]string{"VM Network": "DC0_DVPG0"},
+		err:        "OVF descriptor has no network 'VM Network'",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := newTestSimulator(t, simulator.VPX())
+			sim.ovf.Warning = tt.warning
+			sim.ovf.Error = tt.error
+
+			p := newTestProvisioner(t, sim)
+			p.cfg.NetworkMapping = tt.networks
+			err := resolvePlacement(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := new(Result)
+			cis, err := createImportSpec(p, "test", tt.descriptor, res)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cis.FileItem) != 2 {
+				t.Errorf("got %d file items, want 2", len(cis.FileItem))
+			}
+			if !reflect.DeepEqual(res.Warnings, tt.warnings) {
+				t.Errorf("got warnings %+v, want %+v", res.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestImportRawReportsLeaseProgress(t *testing.T) {
+	sim := newTestSimulator(t, simulator.VPX())
+	sim.waitForProgress = true
+
+	cfg := sim.config()
+	cfg.ResourcePool = "DC0_C0/Resources"
+	p, err := NewProvisioner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	disk := make([]byte, 4*grainSize)
+	copy(disk[grainSize:], "not a zero grain")
+
+	opts := &VMOptions{DiskSize: int64(len(disk))}
+	_, err = p.ProvisionRaw("raw", ioutil.NopCloser(bytes.NewReader(disk)), opts, progress.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sim.ovf.items; len(got) != 1 || got[0].Size != int64(len(disk)) {
+		t.Errorf("got file items %+v, want one of %d bytes", got, len(disk))
+	}
+
+	reports := sim.lastLease().reports()
+	if len(reports) == 0 {
+		t.Fatal("lease progress never reported")
+	}
+	for _, percent := range reports {
+		if percent < 0 || percent > 100 {
+			t.Errorf("lease progress reported as %d%%", percent)
+		}
+	}
+
+	vmdk := sim.upload("disk.vmdk")
+	if len(vmdk) < 4 || binary.LittleEndian.Uint32(vmdk) != vmdkMagic {
+		t.Errorf("uploaded disk is not a VMDK")
+	}
+}
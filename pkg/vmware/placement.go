@@ -0,0 +1,223 @@
+package vmware
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ipAllocationPolicies maps the IP allocation policies accepted in Config to
+// their vSphere names.
+var ipAllocationPolicies = map[string]string{
+	"dhcp":           string(types.VAppIPAssignmentInfoIpAllocationPolicyDhcpPolicy),
+	"transient":      string(types.VAppIPAssignmentInfoIpAllocationPolicyTransientPolicy),
+	"fixed":          string(types.VAppIPAssignmentInfoIpAllocationPolicyFixedPolicy),
+	"fixedAllocated": string(types.VAppIPAssignmentInfoIpAllocationPolicyFixedAllocatedPolicy),
+}
+
+// validateImportSettings checks the import settings of cfg.
+func validateImportSettings(cfg *Config) error {
+	switch types.OvfCreateImportSpecParamsDiskProvisioningType(cfg.DiskProvisioning) {
+	case "",
+		types.OvfCreateImportSpecParamsDiskProvisioningTypeThin,
+		types.OvfCreateImportSpecParamsDiskProvisioningTypeThick,
+		types.OvfCreateImportSpecParamsDiskProvisioningTypeEagerZeroedThick:
+	default:
+		return fmt.Errorf("unsupported disk provisioning type '%s'", cfg.DiskProvisioning)
+	}
+
+	if _, ok := ipAllocationPolicies[cfg.IPAllocationPolicy]; !ok && cfg.IPAllocationPolicy != "" {
+		return fmt.Errorf("unsupported IP allocation policy '%s'", cfg.IPAllocationPolicy)
+	}
+
+	switch types.VAppIPAssignmentInfoProtocols(cfg.IPProtocol) {
+	case "", types.VAppIPAssignmentInfoProtocolsIPv4, types.VAppIPAssignmentInfoProtocolsIPv6:
+	default:
+		return fmt.Errorf("unsupported IP protocol '%s'", cfg.IPProtocol)
+	}
+
+	return nil
+}
+
+// resolvePlacement finds the folder, resource pool, host and networks named
+// in the Config, so that mistakes are reported before an import starts.
+func resolvePlacement(p *Provisioner) error {
+	var err error
+
+	if p.cfg.Folder != "" {
+		p.vsphere.folder, err = p.vsphere.finder.Folder(p.ctx, p.cfg.Folder)
+	} else {
+		var folders *object.DatacenterFolders
+		folders, err = p.vsphere.datacenter.Folders(p.ctx)
+		if folders != nil {
+			p.vsphere.folder = folders.VmFolder
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var cluster *object.ClusterComputeResource
+	if p.cfg.Cluster != "" {
+		cluster, err = p.vsphere.finder.ClusterComputeResource(p.ctx, p.cfg.Cluster)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.cfg.Host != "" {
+		p.vsphere.host, err = p.vsphere.finder.HostSystem(p.ctx, p.cfg.Host)
+		if err != nil {
+			return err
+		}
+
+		if cluster != nil {
+			hosts, err := cluster.Hosts(p.ctx)
+			if err != nil {
+				return err
+			}
+			found := false
+			for _, h := range hosts {
+				if h.Reference() == p.vsphere.host.Reference() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("host '%s' is not in cluster '%s'", p.cfg.Host, p.cfg.Cluster)
+			}
+		}
+	}
+
+	switch {
+	case p.cfg.ResourcePool != "":
+		p.vsphere.resourcepool, err = p.vsphere.finder.ResourcePool(p.ctx, p.cfg.ResourcePool)
+	case cluster != nil:
+		p.vsphere.resourcepool, err = cluster.ResourcePool(p.ctx)
+	case p.vsphere.host != nil:
+		p.vsphere.resourcepool, err = p.vsphere.host.ResourcePool(p.ctx)
+	default:
+		p.vsphere.resourcepool, err = p.vsphere.finder.ResourcePoolOrDefault(p.ctx, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	p.vsphere.networks = make(map[string]types.ManagedObjectReference)
+	for name, path := range p.cfg.NetworkMapping {
+		network, err := p.vsphere.finder.Network(p.ctx, path)
+		if err != nil {
+			return err
+		}
+		p.vsphere.networks[name] = network.Reference()
+	}
+
+	return nil
+}
+
+// propertyIDs returns the IDs of the properties declared in the OVF
+// envelope, in the form vSphere expects in a property mapping.
+func propertyIDs(env *ovf.Envelope) map[string]bool {
+	var sections []ovf.ProductSection
+	if env.Product != nil {
+		sections = append(sections, *env.Product)
+	}
+	if env.VirtualSystem != nil {
+		sections = append(sections, env.VirtualSystem.Product...)
+	}
+
+	ids := make(map[string]bool)
+	for _, s := range sections {
+		for _, prop := range s.Property {
+			id := prop.Key
+			if s.Class != nil && *s.Class != "" {
+				id = *s.Class + "." + id
+			}
+			if s.Instance != nil && *s.Instance != "" {
+				id += "." + *s.Instance
+			}
+			ids[id] = true
+		}
+	}
+
+	return ids
+}
+
+// importSpecParams builds the parameters of an import of the OVF descriptor
+// as name, checking that the configured networks and properties exist in it.
+func importSpecParams(p *Provisioner, name, descriptor string) (types.OvfCreateImportSpecParams, error) {
+	params := types.OvfCreateImportSpecParams{
+		DiskProvisioning:   string(types.OvfCreateImportSpecParamsDiskProvisioningTypeThin),
+		EntityName:         name,
+		IpAllocationPolicy: string(types.VAppIPAssignmentInfoIpAllocationPolicyDhcpPolicy),
+		IpProtocol:         string(types.VAppIPAssignmentInfoProtocolsIPv4),
+		OvfManagerCommonParams: types.OvfManagerCommonParams{
+			DeploymentOption: "",
+			Locale:           "US",
+		},
+		PropertyMapping: make([]types.KeyValue, 0),
+		NetworkMapping:  make([]types.OvfNetworkMapping, 0),
+	}
+
+	if p.cfg.DiskProvisioning != "" {
+		params.DiskProvisioning = p.cfg.DiskProvisioning
+	}
+	if p.cfg.IPAllocationPolicy != "" {
+		params.IpAllocationPolicy = ipAllocationPolicies[p.cfg.IPAllocationPolicy]
+	}
+	if p.cfg.IPProtocol != "" {
+		params.IpProtocol = p.cfg.IPProtocol
+	}
+
+	if len(p.vsphere.networks) == 0 && len(p.cfg.Properties) == 0 {
+		return params, nil
+	}
+
+	env, err := ovf.Unmarshal(strings.NewReader(descriptor))
+	if err != nil {
+		return params, err
+	}
+
+	networks := make(map[string]bool)
+	if env.Network != nil {
+		for _, n := range env.Network.Networks {
+			networks[n.Name] = true
+		}
+	}
+
+	var unknown []string
+	for name, ref := range p.vsphere.networks {
+		if !networks[name] {
+			unknown = append(unknown, "network '"+name+"'")
+			continue
+		}
+		params.NetworkMapping = append(params.NetworkMapping, types.OvfNetworkMapping{
+			Name:    name,
+			Network: ref,
+		})
+	}
+
+	ids := propertyIDs(env)
+	for id, value := range p.cfg.Properties {
+		if !ids[id] {
+			unknown = append(unknown, "property '"+id+"'")
+			continue
+		}
+		params.PropertyMapping = append(params.PropertyMapping, types.KeyValue{
+			Key:   id,
+			Value: value,
+		})
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return params, errors.New("OVF descriptor has no " + strings.Join(unknown, ", "))
+	}
+
+	return params, nil
+}
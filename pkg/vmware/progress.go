@@ -0,0 +1,92 @@
+package vmware
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/sisatech/progress"
+	"github.com/vmware/govmomi/nfc"
+	vprogress "github.com/vmware/govmomi/vim25/progress"
+)
+
+// fileProgress counts the bytes read from the source of one file of a lease
+// and reports them to a subtracker of the file and to the tracker of the
+// whole lease.
+type fileProgress struct {
+	r     io.Reader
+	pt    progress.ProgressTracker
+	lease progress.ProgressTracker
+	pos   int64
+	size  int64
+}
+
+// newFileProgress returns a reader of the source r of item, of size bytes,
+// that reports its progress to a new subtracker of lease.
+func newFileProgress(lease progress.ProgressTracker, item nfc.FileItem, r io.Reader, size int64) *fileProgress {
+	pt := lease.NewSubtracker()
+	pt.Initialize("Uploading "+item.Path+".", float64(size), progress.UnitBytes)
+
+	return &fileProgress{
+		r:     r,
+		pt:    pt,
+		lease: lease,
+		size:  size,
+	}
+}
+
+func (f *fileProgress) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&f.pos, int64(n))
+		f.pt.IncrementProgress(float64(n))
+		f.lease.IncrementProgress(float64(n))
+	}
+	return n, err
+}
+
+// done closes the subtracker of the file with err.
+func (f *fileProgress) done(err error) {
+	f.pt.Close(err)
+}
+
+// fileReport is a progress report in the form the lease updater expects.
+type fileReport struct {
+	vprogress.Report
+	pos  int64
+	size int64
+}
+
+func (r fileReport) Percentage() float32 {
+	if r.size <= 0 {
+		return 0
+	}
+	return 100 * float32(r.pos) / float32(r.size)
+}
+
+// sink returns a progress sink for an upload of the file whose source f
+// reads. The upload's own reports are in bytes sent, which is useless when
+// the length of the upload is unknown, so the reports passed on to item,
+// from which the lease updater reports the progress of the lease to
+// vCenter, are rewritten in terms of the bytes of the source read instead.
+func (f *fileProgress) sink(item nfc.FileItem) vprogress.Sinker {
+	return vprogress.SinkFunc(func() chan<- vprogress.Report {
+		ch := make(chan vprogress.Report)
+		go func() {
+			out := item.Sink()
+			for r := range ch {
+				// the updater stops listening once the lease is done, so
+				// reports it is not ready for are dropped
+				select {
+				case out <- fileReport{
+					Report: r,
+					pos:    atomic.LoadInt64(&f.pos),
+					size:   f.size,
+				}:
+				default:
+				}
+			}
+			close(out)
+		}()
+		return ch
+	})
+}
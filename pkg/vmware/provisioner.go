@@ -1,18 +1,21 @@
 package vmware
 
 import (
+	"bufio"
 	"context"
-	"fmt"
+	"errors"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
+	"reflect"
 
+	"github.com/sisatech/progress"
+	"github.com/sisatech/provisioner/pkg/internal/upload"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
@@ -23,12 +26,15 @@ type Provisioner struct {
 	cfg     *Config
 	ctx     context.Context
 	vclient *govmomi.Client
+	esxi    bool // connected directly to an ESXi host rather than to vCenter
 	vsphere struct {
 		finder       *find.Finder
 		datacenter   *object.Datacenter
 		datastore    *object.Datastore
 		host         *object.HostSystem
 		resourcepool *object.ResourcePool
+		folder       *object.Folder
+		networks     map[string]types.ManagedObjectReference // OVF network names mapped to inventory networks
 	}
 }
 
@@ -39,17 +45,47 @@ func NewProvisioner(cfg *Config) (*Provisioner, error) {
 	p.ctx = context.TODO()
 	p.cfg = cfg
 
+	err := validateImportSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	loginURL, err := url.Parse(p.cfg.Address)
 	if err != nil {
 		return nil, err
 	}
 
-	loginURL.User = url.UserPassword(p.cfg.Username, p.cfg.Password)
-	p.vclient, err = govmomi.NewClient(p.ctx, loginURL, true)
+	soapClient := soap.NewClient(loginURL, p.cfg.Insecure)
+	err = configureTLS(p, soapClient)
+	if err != nil {
+		return nil, err
+	}
+
+	vimClient, err := vim25.NewClient(p.ctx, soapClient)
 	if err != nil {
 		return nil, err
 	}
 
+	p.vclient = &govmomi.Client{
+		Client:         vimClient,
+		SessionManager: session.NewManager(vimClient),
+	}
+
+	err = p.vclient.Login(p.ctx, url.UserPassword(p.cfg.Username, p.cfg.Password))
+	if err != nil {
+		return nil, err
+	}
+
+	p.client = &p.vclient.Client.Client.Client
+
+	p.esxi = !p.vclient.IsVC()
+	if p.esxi {
+		err = validateESXi(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	p.vsphere.finder = find.NewFinder(p.vclient.Client, true)
 	p.vsphere.datacenter, err = p.vsphere.finder.DatacenterOrDefault(p.ctx, p.cfg.Datacenter)
 	if err != nil {
@@ -63,7 +99,7 @@ func NewProvisioner(cfg *Config) (*Provisioner, error) {
 		return nil, err
 	}
 
-	p.vsphere.resourcepool, err = p.vsphere.finder.ResourcePoolOrDefault(p.ctx, p.cfg.ResourcePool)
+	err = resolvePlacement(p)
 	if err != nil {
 		return nil, err
 	}
@@ -76,91 +112,149 @@ func (p *Provisioner) Do(req *http.Request) (*http.Response, error) {
 	return p.client.Do(req)
 }
 
-// Provision ...
+// Close logs out of vCenter. The Provisioner must not be used afterwards.
+func (p *Provisioner) Close() error {
+	return p.vclient.Logout(p.ctx)
+}
+
+// Warning is a problem vCenter found with an import that did not prevent it,
+// such as a setting in the OVF descriptor that had to be ignored.
+type Warning struct {
+	Fault   string // Name of the vSphere fault type, e.g. "OvfUnsupportedSection"
+	Message string // Localized description of the warning
+}
+
+func newWarning(f types.LocalizedMethodFault) Warning {
+	w := Warning{
+		Message: f.LocalizedMessage,
+	}
+	if f.Fault != nil {
+		w.Fault = reflect.Indirect(reflect.ValueOf(f.Fault)).Type().Name()
+	}
+	return w
+}
+
+// Result describes a completed import.
+type Result struct {
+	Warnings []Warning // Warnings raised by vCenter while importing the image
+}
+
+// Provision imports the image read from r as the template f. An OVA is
+// imported as it is; anything else is treated as a raw disk and imported
+// with the default VMOptions. Either way the image is streamed: disks are
+// uploaded as they are read.
 func (p *Provisioner) Provision(f string, r io.ReadCloser) error {
+	_, err := p.ProvisionWithProgress(f, r, progress.NewProgressTracker())
+	return err
+}
 
-	folder, err := p.vsphere.finder.FolderOrDefault(p.ctx, "/")
-	if err != nil {
-		return err
+// ProvisionWithProgress is Provision, reporting each stage of the import to
+// a weighted subtracker of pt, and the upload of each file to a subtracker of
+// the upload's subtracker.
+func (p *Provisioner) ProvisionWithProgress(f string, r io.ReadCloser, pt progress.ProgressTracker) (res *Result, err error) {
+
+	size := upload.SourceSize(r)
+	br := bufio.NewReader(r)
+	if !isOVA(br) {
+		return provisionRaw(p, f, br, size, nil, pt)
 	}
 
-	rBytes, err := ioutil.ReadAll(r)
+	stages := newImportStages(pt)
+	defer func() { stages.Close(err) }()
+	res = new(Result)
+
+	vm, err := importOVA(p, f, br, res, stages)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	importParams := types.OvfCreateImportSpecParams{
-		DiskProvisioning:   "THIN",
-		EntityName:         f,
-		IpAllocationPolicy: "DHCP",
-		IpProtocol:         "IPV4",
-		OvfManagerCommonParams: types.OvfManagerCommonParams{
-			DeploymentOption: "",
-			Locale:           "US",
-		},
-		PropertyMapping: make([]types.KeyValue, 0),
-		NetworkMapping:  make([]types.OvfNetworkMapping, 0),
+	return res, finishTemplate(p, vm, f, stages.Next())
+}
+
+// ProvisionRaw converts the raw disk read from r into a stream-optimized
+// VMDK, builds a virtual machine around it as described by opts, and imports
+// it as the template f in one pass. Progress is reported to pt as it is by
+// ProvisionWithProgress.
+func (p *Provisioner) ProvisionRaw(f string, r io.ReadCloser, opts *VMOptions, pt progress.ProgressTracker) (*Result, error) {
+	return provisionRaw(p, f, r, upload.SourceSize(r), opts, pt)
+}
+
+func provisionRaw(p *Provisioner, f string, r io.Reader, size int64, opts *VMOptions, pt progress.ProgressTracker) (res *Result, err error) {
+
+	o := new(VMOptions)
+	if opts != nil {
+		*o = *opts
 	}
+	opts = o
 
-	ovfManager := ovf.NewManager(p.vclient.Client)
-	cis, err := ovfManager.CreateImportSpec(p.ctx, string(rBytes), p.vsphere.resourcepool, p.vsphere.datastore, importParams)
+	err = validateVMOptions(opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if cis.Error != nil {
-		return fmt.Errorf("%s", cis.Error[0].LocalizedMessage)
+
+	if opts.DiskSize > 0 {
+		size = opts.DiskSize
 	}
-	if cis.Warning != nil {
-		for _, w := range cis.Warning {
-			fmt.Printf("%s\n", w.LocalizedMessage)
-		}
+	if size <= 0 {
+		return nil, errors.New("the size of the disk must be known to import it")
 	}
 
-	lease, err := p.vsphere.resourcepool.ImportVApp(p.ctx, cis.ImportSpec, folder, p.vsphere.host)
-	if err != nil {
-		return err
-	}
+	stages := newImportStages(pt)
+	defer func() { stages.Close(err) }()
+	res = new(Result)
 
-	inf, err := lease.Wait(p.ctx, cis.FileItem)
+	vm, err := importRaw(p, f, r, size, opts, res, stages)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	updater := lease.StartUpdater(p.ctx, inf)
-	defer updater.Done()
-
-	for _, item := range inf.Items {
-		err = func() error {
-			var f *os.File
-			f, err = os.Open(item.Path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+	return res, finishTemplate(p, vm, f, stages.Next())
+}
 
-			var s os.FileInfo
-			s, err = os.Stat(f.Name())
-			if err != nil {
-				return err
-			}
+// newImportStages divides the progress of an import reported to pt between
+// creating the import spec and waiting for the lease, uploading files to the
+// lease, and finishing the template.
+func newImportStages(pt progress.ProgressTracker) *progress.WeightedStages {
+	return progress.NewWeightedStages(pt, "Importing virtual machine image.",
+		progress.StageWeight{Name: "Preparing import.", Weight: 5},
+		progress.StageWeight{Name: "Uploading files.", Weight: 85},
+		progress.StageWeight{Name: "Finishing template.", Weight: 10},
+	)
+}
 
-			opts := soap.Upload{
-				ContentLength: s.Size(),
-			}
+// finishTemplate publishes an imported virtual machine to the content
+// library, if one is configured, and marks it as a template. It is
+// published first, while it can still be exported as a virtual machine. On
+// a standalone ESXi host the virtual machine is annotated instead. Progress
+// is reported to pt.
+func finishTemplate(p *Provisioner, vm *object.VirtualMachine, name string, pt progress.ProgressTracker) error {
+	steps := 1
+	if p.cfg.ContentLibrary != "" {
+		steps++
+	}
+	pt.Initialize("Finishing template.", float64(steps), progress.UnitStep)
 
-			return lease.Upload(p.ctx, item, f, opts)
-		}()
+	if p.cfg.ContentLibrary != "" {
+		pt.SetStage("Publishing to content library.")
+		err := publishToLibrary(p, vm, name)
 		if err != nil {
 			return err
 		}
+		pt.IncrementProgress(1)
 	}
 
-	var vm *object.VirtualMachine
-	vm, err = p.vsphere.finder.VirtualMachine(p.ctx, f)
+	var err error
+	if p.esxi {
+		pt.SetStage("Annotating virtual machine.")
+		err = annotateVM(p, vm)
+	} else {
+		pt.SetStage("Marking as template.")
+		err = vm.MarkAsTemplate(p.ctx)
+	}
 	if err != nil {
 		return err
 	}
+	pt.IncrementProgress(1)
 
-	err = vm.MarkAsTemplate(p.ctx)
-	return err
+	return nil
 }
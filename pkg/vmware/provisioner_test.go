@@ -0,0 +1,203 @@
+package vmware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sisatech/progress"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestNewProvisionerResolvesInventory(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		pool    string // inventory path of the resource pool chosen
+		host    string // inventory path of the host chosen, if any
+		folder  string // inventory path of the folder chosen
+		network string // network "VM Network" is mapped to, if any
+		err     string
+	}{{
+		name:   "explicit",
+		cfg:    Config{Datacenter: "DC0", Datastore: "LocalDS_0", ResourcePool: "/DC0/host/DC0_H0/Resources"},
+		pool:   "/DC0/host/DC0_H0/Resources",
+		folder: "/DC0/vm",
+	}, {
+		name:   "cluster",
+		cfg:    Config{Cluster: "DC0_C0"},
+		pool:   "/DC0/host/DC0_C0/Resources",
+		folder: "/DC0/vm",
+	}, {
+		name:   "host in cluster",
+		cfg:    Config{Cluster: "DC0_C0", Host: "DC0_C0_H1"},
+		pool:   "/DC0/host/DC0_C0/Resources",
+		host:   "/DC0/host/DC0_C0/DC0_C0_H1",
+		folder: "/DC0/vm",
+	}, {
+		name:   "standalone host",
+		cfg:    Config{Host: "DC0_H0"},
+		pool:   "/DC0/host/DC0_H0/Resources",
+		host:   "/DC0/host/DC0_H0/DC0_H0",
+		folder: "/DC0/vm",
+	}, {
+		name:   "folder",
+		cfg:    Config{Cluster: "DC0_C0", Folder: "/DC0/vm"},
+		pool:   "/DC0/host/DC0_C0/Resources",
+		folder: "/DC0/vm",
+	}, {
+		name:    "network",
+		cfg:     Config{Cluster: "DC0_C0", NetworkMapping: map[string]string{"VM Network": "DC0_DVPG0"}},
+		pool:    "/DC0/host/DC0_C0/Resources",
+		folder:  "/DC0/vm",
+		network: "/DC0/network/DC0_DVPG0",
+	}, {
+		name: "host outside cluster",
+		cfg:  Config{Cluster: "DC0_C0", Host: "DC0_H0"},
+		err:  "host 'DC0_H0' is not in cluster 'DC0_C0'",
+	}, {
+		name: "missing datacenter",
+		cfg:  Config{Datacenter: "DC1"},
+		err:  "datacenter 'DC1' not found",
+	}, {
+		name: "missing datastore",
+		cfg:  Config{Datastore: "LocalDS_1"},
+		err:  "datastore 'LocalDS_1' not found",
+	}, {
+		name: "missing cluster",
+		cfg:  Config{Cluster: "DC0_C1"},
+		err:  "cluster 'DC0_C1' not found",
+	}, {
+		name: "missing folder",
+		cfg:  Config{Cluster: "DC0_C0", Folder: "/DC0/vm/templates"},
+		err:  "folder '/DC0/vm/templates' not found",
+	}, {
+		name: "missing network",
+		cfg:  Config{Cluster: "DC0_C0", NetworkMapping: map[string]string{"VM Network": "DC0_DVPG1"}},
+		err:  "network 'DC0_DVPG1' not found",
+	}, {
+		name: "invalid setting",
+		cfg:  Config{DiskProvisioning: "sparse"},
+		err:  "unsupported disk provisioning type 'sparse'",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := newTestSimulator(t, simulator.VPX())
+
+			cfg := tt.cfg
+			login := sim.config()
+			cfg.Address, cfg.Username, cfg.Password = login.Address, login.Username, login.Password
+
+			p, err := NewProvisioner(&cfg)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			if got := p.vsphere.datacenter.InventoryPath; got != "/DC0" {
+				t.Errorf("got datacenter %s, want /DC0", got)
+			}
+			if got := p.vsphere.datastore.InventoryPath; got != "/DC0/datastore/LocalDS_0" {
+				t.Errorf("got datastore %s, want /DC0/datastore/LocalDS_0", got)
+			}
+			if got := inventoryPath(p.vsphere.resourcepool.Reference()); got != tt.pool {
+				t.Errorf("got resource pool %s, want %s", got, tt.pool)
+			}
+			if got := inventoryPath(p.vsphere.folder.Reference()); got != tt.folder {
+				t.Errorf("got folder %s, want %s", got, tt.folder)
+			}
+
+			host := ""
+			if p.vsphere.host != nil {
+				host = inventoryPath(p.vsphere.host.Reference())
+			}
+			if host != tt.host {
+				t.Errorf("got host %q, want %q", host, tt.host)
+			}
+
+			network := ""
+			if ref, ok := p.vsphere.networks["VM Network"]; ok {
+				network = inventoryPath(ref)
+			}
+			if network != tt.network {
+				t.Errorf("got network %q, want %q", network, tt.network)
+			}
+		})
+	}
+}
+
+func TestCloseLogsOut(t *testing.T) {
+	sim := newTestSimulator(t, simulator.VPX())
+
+	cfg := sim.config()
+	cfg.Cluster = "DC0_C0"
+	p, err := NewProvisioner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := p.vclient.SessionManager.UserSession(p.ctx)
+	if err != nil || session == nil {
+		t.Fatalf("not logged in: %v", err)
+	}
+
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err = p.vclient.SessionManager.UserSession(p.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session != nil {
+		t.Errorf("still logged in as %s", session.UserName)
+	}
+}
+
+func TestProvisionMarksAsTemplate(t *testing.T) {
+	sim := newTestSimulator(t, simulator.VPX())
+
+	cfg := sim.config()
+	cfg.Cluster = "DC0_C0"
+	p, err := NewProvisioner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, err = p.ProvisionWithProgress("template", newTestOVA(t, testOVAFiles), progress.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := importedVM(t, sim)
+	if vm.Name != "template" {
+		t.Errorf("got virtual machine %s, want template", vm.Name)
+	}
+	if !vm.Config.Template {
+		t.Error("virtual machine not marked as a template")
+	}
+}
+
+// inventoryPath returns the inventory path of the simulator's object ref.
+func inventoryPath(ref types.ManagedObjectReference) string {
+	var names []string
+	for {
+		e := simulator.Map.Get(ref).(mo.Entity).Entity()
+		if e.Parent == nil {
+			break
+		}
+		names = append([]string{e.Name}, names...)
+		ref = *e.Parent
+	}
+	return "/" + strings.Join(names, "/")
+}
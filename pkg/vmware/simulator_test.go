@@ -0,0 +1,347 @@
+package vmware
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// The simulator does not implement imports, so testSimulator adds an
+// OvfManager, ImportVApp and NFC leases that do just enough of what vCenter
+// does for an import to run against it.
+
+// testSimulator is a running vCenter simulator.
+type testSimulator struct {
+	server *simulator.Server
+	ovf    *testOvfManager
+
+	// waitForProgress holds each upload open until its lease has been told
+	// of its progress, which the lease updater does every two seconds.
+	waitForProgress bool
+
+	lock    sync.Mutex
+	leases  []*testLease
+	uploads map[string][]byte // bodies of the files uploaded, keyed by name
+}
+
+// newTestSimulator creates and starts a simulator of model, and stops it
+// when the test finishes.
+func newTestSimulator(t *testing.T, model *simulator.Model) *testSimulator {
+	err := model.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSimulator{
+		server:  model.Service.NewServer(),
+		uploads: make(map[string][]byte),
+	}
+	t.Cleanup(func() {
+		s.server.Close()
+		model.Remove()
+	})
+
+	content := simulator.Map.Get(vim25.ServiceInstance).(*simulator.ServiceInstance).Content
+
+	s.ovf = &testOvfManager{sim: s}
+	s.ovf.Self = *content.OvfManager
+	simulator.Map.Put(s.ovf)
+
+	for _, pool := range resourcePools(content.RootFolder) {
+		simulator.Map.Put(&testResourcePool{
+			ResourcePool: pool,
+			sim:          s,
+		})
+	}
+
+	model.Service.ServeMux.HandleFunc("/nfc/", s.serveUpload)
+
+	return s
+}
+
+// resourcePools returns the resource pools in the inventory below ref.
+func resourcePools(ref types.ManagedObjectReference) []*simulator.ResourcePool {
+	var refs []types.ManagedObjectReference
+	var pools []*simulator.ResourcePool
+
+	switch obj := simulator.Map.Get(ref).(type) {
+	case *simulator.Folder:
+		refs = obj.ChildEntity
+	case *simulator.Datacenter:
+		refs = append(refs, obj.HostFolder)
+	case *mo.ComputeResource:
+		refs = append(refs, *obj.ResourcePool)
+	case *simulator.ClusterComputeResource:
+		refs = append(refs, *obj.ResourcePool)
+	case *simulator.ResourcePool:
+		pools = append(pools, obj)
+		refs = obj.ResourcePool.ResourcePool
+	}
+
+	for _, ref := range refs {
+		pools = append(pools, resourcePools(ref)...)
+	}
+	return pools
+}
+
+// config returns a Config that logs in to the simulator.
+func (s *testSimulator) config() *Config {
+	u := *s.server.URL
+	u.User = nil
+	password, _ := s.server.URL.User.Password()
+
+	return &Config{
+		Address:  u.String(),
+		Username: s.server.URL.User.Username(),
+		Password: password,
+	}
+}
+
+// serveUpload accepts a file of an import.
+func (s *testSimulator) serveUpload(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.uploads[path.Base(r.URL.Path)] = body
+	lease := s.leases[len(s.leases)-1]
+	s.lock.Unlock()
+
+	if s.waitForProgress {
+		err = lease.waitForProgress(5 * time.Second)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// upload returns the body of the file uploaded as name.
+func (s *testSimulator) upload(name string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.uploads[name]
+}
+
+// lastLease returns the lease of the last import, if any.
+func (s *testSimulator) lastLease() *testLease {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.leases) == 0 {
+		return nil
+	}
+	return s.leases[len(s.leases)-1]
+}
+
+// testOvfManager creates import specs with a file item for each file the
+// descriptor references, sized as the descriptor says, as vCenter does.
+type testOvfManager struct {
+	mo.OvfManager
+	sim *testSimulator
+
+	Warning []types.LocalizedMethodFault // returned with every import spec
+	Error   []types.LocalizedMethodFault // returned instead of an import spec
+
+	params types.OvfCreateImportSpecParams // of the last request
+	items  []types.OvfFileItem             // of the last import spec
+}
+
+func (m *testOvfManager) CreateImportSpec(req *types.CreateImportSpec) soap.HasFault {
+	body := new(methods.CreateImportSpecBody)
+	m.params = req.Cisp
+	m.items = nil
+
+	env, err := ovf.Unmarshal(strings.NewReader(req.OvfDescriptor))
+	if err != nil {
+		body.Fault_ = simulator.Fault(err.Error(), &types.InvalidArgument{InvalidProperty: "ovfDescriptor"})
+		return body
+	}
+
+	res := types.OvfCreateImportSpecResult{
+		Warning: m.Warning,
+		Error:   m.Error,
+	}
+	if len(m.Error) == 0 {
+		ds := simulator.Map.Get(req.Datastore).(*simulator.Datastore)
+		res.ImportSpec = &types.VirtualMachineImportSpec{
+			ConfigSpec: types.VirtualMachineConfigSpec{
+				Name: req.Cisp.EntityName,
+				Files: &types.VirtualMachineFileInfo{
+					VmPathName: "[" + ds.Name + "]",
+				},
+			},
+		}
+		for _, f := range env.References {
+			m.items = append(m.items, types.OvfFileItem{
+				DeviceId: f.ID,
+				Path:     f.Href,
+				Size:     int64(f.Size),
+			})
+		}
+		res.FileItem = m.items
+	}
+
+	body.Res = &types.CreateImportSpecResponse{
+		Returnval: res,
+	}
+	return body
+}
+
+// testResourcePool adds ImportVApp to the simulator's resource pools. The
+// virtual machine is created as soon as the import starts.
+type testResourcePool struct {
+	*simulator.ResourcePool
+	sim *testSimulator
+}
+
+// Get lets the property collector read the wrapped resource pool.
+func (p *testResourcePool) Get() mo.Reference {
+	return p.ResourcePool
+}
+
+func (p *testResourcePool) ImportVApp(ctx *simulator.Context, req *types.ImportVApp) soap.HasFault {
+	body := new(methods.ImportVAppBody)
+
+	spec, ok := req.Spec.(*types.VirtualMachineImportSpec)
+	if !ok || req.Folder == nil {
+		body.Fault_ = simulator.Fault("", &types.InvalidArgument{InvalidProperty: "spec"})
+		return body
+	}
+
+	// the pool is locked for this call already
+	self := p.Self
+	ctx.Caller = &self
+
+	folder := simulator.Map.Get(*req.Folder).(*simulator.Folder)
+	res := folder.CreateVMTask(ctx, &types.CreateVM_Task{
+		This:   folder.Self,
+		Config: spec.ConfigSpec,
+		Pool:   p.Self,
+		Host:   req.Host,
+	}).(*methods.CreateVM_TaskBody)
+	task := simulator.Map.Get(res.Res.Returnval).(*simulator.Task)
+	if task.Info.Error != nil {
+		body.Fault_ = simulator.Fault(task.Info.Error.LocalizedMessage, task.Info.Error.Fault)
+		return body
+	}
+
+	lease := &testLease{
+		progress: make(chan struct{}),
+	}
+	lease.Self = types.ManagedObjectReference{Type: "HttpNfcLease"}
+	simulator.Map.Put(lease)
+
+	lease.Info = &types.HttpNfcLeaseInfo{
+		Lease:        lease.Self,
+		Entity:       task.Info.Result.(types.ManagedObjectReference),
+		LeaseTimeout: 300,
+	}
+	for _, item := range p.sim.ovf.items {
+		lease.Info.DeviceUrl = append(lease.Info.DeviceUrl, types.HttpNfcLeaseDeviceUrl{
+			Key:       "/" + item.DeviceId,
+			ImportKey: item.DeviceId,
+			Url:       "http://*/nfc/" + lease.Self.Value + "/" + item.Path,
+		})
+	}
+	lease.State = types.HttpNfcLeaseStateReady
+
+	p.sim.lock.Lock()
+	p.sim.leases = append(p.sim.leases, lease)
+	p.sim.lock.Unlock()
+
+	body.Res = &types.ImportVAppResponse{
+		Returnval: lease.Self,
+	}
+	return body
+}
+
+// testLease is an NFC lease that records what it is told.
+type testLease struct {
+	mo.HttpNfcLease
+
+	lock     sync.Mutex
+	percents []int32                     // reported by HttpNfcLeaseProgress
+	aborted  *types.LocalizedMethodFault // passed to HttpNfcLeaseAbort
+	progress chan struct{}               // closed by the first HttpNfcLeaseProgress
+	reported sync.Once
+}
+
+// HttpNfcLeaseProgress records percent, rejecting it as vCenter does if it
+// is out of range.
+func (l *testLease) HttpNfcLeaseProgress(req *types.HttpNfcLeaseProgress) soap.HasFault {
+	body := new(methods.HttpNfcLeaseProgressBody)
+
+	l.lock.Lock()
+	l.percents = append(l.percents, req.Percent)
+	l.lock.Unlock()
+	l.reported.Do(func() { close(l.progress) })
+
+	if req.Percent < 0 || req.Percent > 100 {
+		body.Fault_ = simulator.Fault("", &types.InvalidArgument{InvalidProperty: "percent"})
+		return body
+	}
+
+	body.Res = new(types.HttpNfcLeaseProgressResponse)
+	return body
+}
+
+func (l *testLease) HttpNfcLeaseComplete(req *types.HttpNfcLeaseComplete) soap.HasFault {
+	l.State = types.HttpNfcLeaseStateDone
+	return &methods.HttpNfcLeaseCompleteBody{
+		Res: new(types.HttpNfcLeaseCompleteResponse),
+	}
+}
+
+func (l *testLease) HttpNfcLeaseAbort(req *types.HttpNfcLeaseAbort) soap.HasFault {
+	l.lock.Lock()
+	l.aborted = req.Fault
+	l.lock.Unlock()
+
+	l.State = types.HttpNfcLeaseStateError
+	return &methods.HttpNfcLeaseAbortBody{
+		Res: new(types.HttpNfcLeaseAbortResponse),
+	}
+}
+
+// waitForProgress waits up to timeout for the lease to be told of its
+// progress.
+func (l *testLease) waitForProgress(timeout time.Duration) error {
+	select {
+	case <-l.progress:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("no progress reported")
+	}
+}
+
+// reports returns the percentages the lease has been told of.
+func (l *testLease) reports() []int32 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]int32(nil), l.percents...)
+}
+
+// abortFault returns the fault the lease was aborted with, if any.
+func (l *testLease) abortFault() *types.LocalizedMethodFault {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.aborted
+}
@@ -0,0 +1,158 @@
+package vmware
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// normalizeThumbprint strips the separators and case from a thumbprint, so
+// that "aa:bb:..." and "AABB..." compare equal.
+func normalizeThumbprint(t string) string {
+	t = strings.Replace(t, ":", "", -1)
+	return strings.ToUpper(t)
+}
+
+// certThumbprint returns the thumbprint of cert computed with the hash
+// algorithm implied by the length of expected.
+func certThumbprint(cert *x509.Certificate, expected string) string {
+	if len(expected) == 2*sha256.Size {
+		sum := sha256.Sum256(cert.Raw)
+		return strings.ToUpper(hex.EncodeToString(sum[:]))
+	}
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// hostPort adds the default HTTPS port to addr if it has none.
+func hostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "443")
+	}
+	return addr
+}
+
+// validateTLSSettings checks the TLS settings of cfg and returns its pinned
+// thumbprints keyed by host:port.
+func validateTLSSettings(cfg *Config) (map[string]string, error) {
+	if cfg.Insecure && (cfg.CAFile != "" || len(cfg.Thumbprints) > 0) {
+		return nil, errors.New("Insecure cannot be combined with CAFile or Thumbprints")
+	}
+
+	pins := make(map[string]string)
+	for host, t := range cfg.Thumbprints {
+		t = normalizeThumbprint(t)
+		if _, err := hex.DecodeString(t); err != nil || (len(t) != 2*sha1.Size && len(t) != 2*sha256.Size) {
+			return nil, fmt.Errorf("thumbprint of '%s' is not a SHA-1 or SHA-256 fingerprint", host)
+		}
+		pins[hostPort(host)] = t
+	}
+
+	return pins, nil
+}
+
+// configureTLS applies the trust settings of the Config to the transport of
+// c, before it makes any connection. Since the same transport carries the
+// SOAP and vAPI requests to vCenter and the NFC uploads to ESXi hosts, they
+// are all verified alike.
+//
+// Unless Insecure is set, certificates are verified against the system's CAs
+// and those of CAFile. A host with a pinned thumbprint must present a
+// certificate that matches it, whether or not it is otherwise trusted. A
+// certificate that is not trusted is still accepted if it matches the
+// thumbprint vCenter gives for an ESXi host in an NFC lease.
+func configureTLS(p *Provisioner, c *soap.Client) error {
+	if p.cfg.Insecure {
+		return nil
+	}
+
+	pins, err := validateTLSSettings(p.cfg)
+	if err != nil {
+		return err
+	}
+
+	t, ok := c.Client.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("unexpected transport for vSphere client")
+	}
+
+	if p.cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(p.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", p.cfg.CAFile)
+		}
+
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	config := t.TLSClientConfig
+	t.DialTLS = func(network, addr string) (net.Conn, error) {
+		conn, err := tls.Dial(network, addr, config)
+		if err == nil {
+			if pin, ok := pins[addr]; ok {
+				return checkThumbprint(conn, addr, pin)
+			}
+			return conn, nil
+		}
+
+		if !isUntrusted(err) {
+			return nil, err
+		}
+
+		pin, ok := pins[addr]
+		if !ok {
+			pin = normalizeThumbprint(c.Thumbprint(addr))
+		}
+		if pin == "" {
+			return nil, err
+		}
+
+		conn, err = tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return nil, err
+		}
+
+		return checkThumbprint(conn, addr, pin)
+	}
+
+	return nil
+}
+
+// isUntrusted reports whether err is a failure to verify a certificate that
+// a thumbprint might still vouch for.
+func isUntrusted(err error) bool {
+	var authority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	return errors.As(err, &authority) || errors.As(err, &hostname)
+}
+
+// checkThumbprint closes conn unless the certificate of its peer matches the
+// thumbprint pin.
+func checkThumbprint(conn *tls.Conn, addr, pin string) (net.Conn, error) {
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if certThumbprint(cert, pin) != pin {
+		conn.Close()
+		return nil, fmt.Errorf("certificate of %s does not match thumbprint %s", addr, pin)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,139 @@
+package vmware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// vapiSession is an authenticated session with the vAPI REST endpoints of
+// vCenter, which are separate from the SOAP API used for everything else.
+type vapiSession struct {
+	p    *Provisioner
+	base string
+	id   string
+}
+
+type vapiMessageStruct struct {
+	DefaultMessage string `json:"default_message"`
+}
+
+type vapiErrorStruct struct {
+	Type  string `json:"type"`
+	Value struct {
+		Messages []vapiMessageStruct `json:"messages"`
+	} `json:"value"`
+}
+
+// newVAPIError returns an error describing a failed vAPI response.
+func newVAPIError(statusCode int, body []byte) error {
+	e := new(vapiErrorStruct)
+	if json.Unmarshal(body, e) != nil || len(e.Value.Messages) == 0 {
+		return fmt.Errorf("bad status code %d", statusCode)
+	}
+
+	var msgs []string
+	for _, m := range e.Value.Messages {
+		msgs = append(msgs, m.DefaultMessage)
+	}
+
+	return fmt.Errorf("bad status code %d: %s", statusCode, strings.Join(msgs, "; "))
+}
+
+// newVAPISession logs in to the vAPI endpoints with the configured
+// credentials.
+func newVAPISession(p *Provisioner) (*vapiSession, error) {
+	u, err := url.Parse(p.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &vapiSession{
+		p:    p,
+		base: u.Scheme + "://" + u.Host + "/rest",
+	}
+
+	req, err := http.NewRequest("POST", s.base+"/com/vmware/cis/session", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+
+	result := new(struct {
+		Value string `json:"value"`
+	})
+	err = s.do(req, result)
+	if err != nil {
+		return nil, err
+	}
+	s.id = result.Value
+
+	return s, nil
+}
+
+// do sends req and decodes the body of a successful response into result,
+// unless result is nil.
+func (s *vapiSession) do(req *http.Request, result interface{}) error {
+	if s.id != "" {
+		req.Header.Set("vmware-api-session-id", s.id)
+	}
+
+	resp, err := s.p.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newVAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	if result == nil || len(bodyBytes) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(bodyBytes, result)
+}
+
+// request sends data as JSON to the vAPI path and decodes the value of the
+// response into result.
+func (s *vapiSession) request(verb, path string, data, result interface{}) error {
+	var body []byte
+	if data != nil {
+		var err error
+		body, err = json.Marshal(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(verb, s.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if result == nil {
+		return s.do(req, nil)
+	}
+
+	return s.do(req, &struct {
+		Value interface{} `json:"value"`
+	}{result})
+}
+
+// close logs out of the session.
+func (s *vapiSession) close() error {
+	return s.request("DELETE", "/com/vmware/cis/session", nil, nil)
+}
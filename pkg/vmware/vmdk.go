@@ -0,0 +1,287 @@
+package vmware
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	sectorSize        = 512
+	grainSectors      = 128                       // sectors per grain, the unit of allocation
+	grainSize         = grainSectors * sectorSize // bytes per grain
+	gtEntries         = 512                       // grains described by each grain table
+	descriptorSectors = 20                        // space reserved for the embedded descriptor
+	overheadSectors   = 128                       // sectors before the first grain
+	vmdkMagic         = 0x564d444b                // "KDMV"
+	gdAtEnd           = ^uint64(0)                // grain directory offset meaning "see the footer"
+
+	// header flags: valid newline detection, compressed grains, markers
+	vmdkFlags = 1<<0 | 1<<16 | 1<<17
+
+	markerEOS    = 0
+	markerGT     = 1
+	markerGD     = 2
+	markerFooter = 3
+)
+
+// sparseExtentHeader is the header, and footer, of a stream-optimized VMDK.
+type sparseExtentHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// metadataMarker precedes each grain table, the grain directory and the
+// footer.
+type metadataMarker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+	Pad        [496]byte
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// vmdkDescriptor returns the descriptor embedded in a stream-optimized VMDK
+// of capacity sectors.
+func vmdkDescriptor(capacity int64, adapterType string) (string, error) {
+	cid := make([]byte, 4)
+	_, err := io.ReadFull(rand.Reader, cid)
+	if err != nil {
+		return "", err
+	}
+
+	heads, sectors := int64(255), int64(63)
+	if adapterType == "ide" {
+		heads = 16
+	}
+	cylinders := capacity / (heads * sectors)
+	if cylinders > 65535 {
+		cylinders = 65535
+	}
+
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%s
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "disk.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "%s"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "%d"
+ddb.geometry.sectors = "%d"
+ddb.virtualHWVersion = "4"
+`, hex.EncodeToString(cid), capacity, adapterType, cylinders, heads, sectors), nil
+}
+
+// sectorWriter writes to w, keeping track of the position in sectors.
+type sectorWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (s *sectorWriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	s.pos += int64(n)
+	return n, err
+}
+
+// sector returns the current position, which must be sector aligned.
+func (s *sectorWriter) sector() uint64 {
+	return uint64(s.pos / sectorSize)
+}
+
+// pad writes zeros up to the next sector boundary.
+func (s *sectorWriter) pad() error {
+	if n := s.pos % sectorSize; n != 0 {
+		_, err := s.Write(make([]byte, sectorSize-n))
+		return err
+	}
+	return nil
+}
+
+func (s *sectorWriter) marker(numSectors uint64, markerType uint32) error {
+	return binary.Write(s, binary.LittleEndian, &metadataMarker{
+		NumSectors: numSectors,
+		Type:       markerType,
+	})
+}
+
+// writeStreamOptimized converts the raw disk read from r, of size bytes, into
+// a stream-optimized VMDK written to w. Grains that are entirely zero are
+// left out. The grain tables and directory are written after the grains, so
+// the disk is converted in a single pass.
+func writeStreamOptimized(w io.Writer, r io.Reader, size int64, adapterType string) error {
+
+	capacity := (size + sectorSize - 1) / sectorSize
+	grains := (capacity + grainSectors - 1) / grainSectors
+	tables := (grains + gtEntries - 1) / gtEntries
+
+	descriptor, err := vmdkDescriptor(capacity, adapterType)
+	if err != nil {
+		return err
+	}
+	if len(descriptor) > descriptorSectors*sectorSize {
+		return errors.New("VMDK descriptor is too long")
+	}
+
+	header := sparseExtentHeader{
+		MagicNumber:        vmdkMagic,
+		Version:            3,
+		Flags:              vmdkFlags,
+		Capacity:           uint64(capacity),
+		GrainSize:          grainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     descriptorSectors,
+		NumGTEsPerGT:       gtEntries,
+		GdOffset:           gdAtEnd,
+		OverHead:           overheadSectors,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  1, // deflate
+	}
+
+	sw := &sectorWriter{w: w}
+	err = binary.Write(sw, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(sw, descriptor)
+	if err != nil {
+		return err
+	}
+	_, err = sw.Write(make([]byte, overheadSectors*sectorSize-sw.pos))
+	if err != nil {
+		return err
+	}
+
+	gt := make([]uint32, tables*gtEntries)
+	buf := make([]byte, grainSize)
+	var compressed bytes.Buffer
+
+	for g := int64(0); g < grains; g++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if isZero(buf) {
+			continue
+		}
+
+		compressed.Reset()
+		zw := zlib.NewWriter(&compressed)
+		_, err = zw.Write(buf)
+		if err != nil {
+			return err
+		}
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+
+		gt[g] = uint32(sw.sector())
+		err = binary.Write(sw, binary.LittleEndian, struct {
+			LBA  uint64
+			Size uint32
+		}{uint64(g * grainSectors), uint32(compressed.Len())})
+		if err != nil {
+			return err
+		}
+		_, err = sw.Write(compressed.Bytes())
+		if err != nil {
+			return err
+		}
+		err = sw.pad()
+		if err != nil {
+			return err
+		}
+	}
+
+	// anything beyond the declared size would be lost
+	n, _ := io.ReadFull(r, buf[:1])
+	if n != 0 {
+		return fmt.Errorf("disk is larger than %d bytes", size)
+	}
+
+	gtSectors := uint64(gtEntries * 4 / sectorSize)
+	gd := make([]uint32, tables)
+	for t := int64(0); t < tables; t++ {
+		err = sw.marker(gtSectors, markerGT)
+		if err != nil {
+			return err
+		}
+		gd[t] = uint32(sw.sector())
+		err = binary.Write(sw, binary.LittleEndian, gt[t*gtEntries:(t+1)*gtEntries])
+		if err != nil {
+			return err
+		}
+	}
+
+	gdSectors := (uint64(tables)*4 + sectorSize - 1) / sectorSize
+	err = sw.marker(gdSectors, markerGD)
+	if err != nil {
+		return err
+	}
+	header.GdOffset = sw.sector()
+	err = binary.Write(sw, binary.LittleEndian, gd)
+	if err != nil {
+		return err
+	}
+	err = sw.pad()
+	if err != nil {
+		return err
+	}
+
+	err = sw.marker(1, markerFooter)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(sw, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+
+	return sw.marker(0, markerEOS)
+}
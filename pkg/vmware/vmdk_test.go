@@ -0,0 +1,249 @@
+package vmware
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// streamGrain is a grain read from a stream-optimized VMDK.
+type streamGrain struct {
+	lba  uint64
+	data []byte
+	used bool
+}
+
+// readStreamOptimized parses a stream-optimized VMDK of capacity sectors,
+// checking its layout, and returns the disk it holds.
+func readStreamOptimized(t *testing.T, b []byte, capacity int64, adapterType string) []byte {
+	t.Helper()
+
+	readHeader := func(at int) sparseExtentHeader {
+		var h sparseExtentHeader
+		err := binary.Read(bytes.NewReader(b[at:at+sectorSize]), binary.LittleEndian, &h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	if len(b)%sectorSize != 0 {
+		t.Fatalf("VMDK of %d bytes is not a whole number of sectors", len(b))
+	}
+
+	header := readHeader(0)
+	want := sparseExtentHeader{
+		MagicNumber:        vmdkMagic,
+		Version:            3,
+		Flags:              vmdkFlags,
+		Capacity:           uint64(capacity),
+		GrainSize:          grainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     descriptorSectors,
+		NumGTEsPerGT:       gtEntries,
+		GdOffset:           gdAtEnd,
+		OverHead:           overheadSectors,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  1,
+	}
+	if header != want {
+		t.Fatalf("got header %+v, want %+v", header, want)
+	}
+
+	descriptor := string(bytes.TrimRight(b[sectorSize:(1+descriptorSectors)*sectorSize], "\x00"))
+	for _, line := range []string{
+		`createType="streamOptimized"`,
+		fmt.Sprintf(`RW %d SPARSE "disk.vmdk"`, capacity),
+		fmt.Sprintf(`ddb.adapterType = "%s"`, adapterType),
+	} {
+		if !strings.Contains(descriptor, line+"\n") {
+			t.Errorf("descriptor is missing %s:\n%s", line, descriptor)
+		}
+	}
+	if !isZero(b[sectorSize+len(descriptor) : overheadSectors*sectorSize]) {
+		t.Error("data between the descriptor and the first grain")
+	}
+
+	// walk the stream: grains, then the grain tables, the grain directory,
+	// the footer and the end of stream marker
+	grains := make(map[uint64]*streamGrain) // by sector
+	gts := make(map[uint64]bool)            // sectors of grain tables
+	gdOffset := uint64(0)
+	var lastLBA int64 = -1
+	pos := overheadSectors * sectorSize
+	for {
+		if pos+sectorSize > len(b) {
+			t.Fatal("stream ends without an end of stream marker")
+		}
+		lba := binary.LittleEndian.Uint64(b[pos:])
+		size := binary.LittleEndian.Uint32(b[pos+8:])
+
+		if size != 0 {
+			if gdOffset != 0 || len(gts) != 0 {
+				t.Fatalf("grain at sector %d after the grain tables", pos/sectorSize)
+			}
+			if lba%grainSectors != 0 || int64(lba) <= lastLBA || int64(lba) >= capacity {
+				t.Fatalf("grain at sector %d has LBA %d", pos/sectorSize, lba)
+			}
+			lastLBA = int64(lba)
+
+			zr, err := zlib.NewReader(bytes.NewReader(b[pos+12 : pos+12+int(size)]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != grainSize {
+				t.Fatalf("grain at LBA %d holds %d bytes", lba, len(data))
+			}
+			grains[uint64(pos/sectorSize)] = &streamGrain{lba: lba, data: data}
+
+			pos += (12 + int(size) + sectorSize - 1) / sectorSize * sectorSize
+			continue
+		}
+
+		var marker metadataMarker
+		err := binary.Read(bytes.NewReader(b[pos:pos+sectorSize]), binary.LittleEndian, &marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos += sectorSize
+
+		switch marker.Type {
+		case markerGT:
+			if marker.NumSectors != gtEntries*4/sectorSize || gdOffset != 0 {
+				t.Fatalf("got grain table of %d sectors", marker.NumSectors)
+			}
+			gts[uint64(pos/sectorSize)] = true
+		case markerGD:
+			if gdOffset != 0 {
+				t.Fatal("second grain directory")
+			}
+			gdOffset = uint64(pos / sectorSize)
+		case markerFooter:
+			if marker.NumSectors != 1 {
+				t.Fatalf("got footer of %d sectors", marker.NumSectors)
+			}
+			footer := readHeader(pos)
+			want.GdOffset = gdOffset
+			if gdOffset == 0 || footer != want {
+				t.Fatalf("got footer %+v, want %+v", footer, want)
+			}
+		case markerEOS:
+			if marker.NumSectors != 0 || pos != len(b) {
+				t.Fatalf("end of stream marker at %d of %d bytes", pos-sectorSize, len(b))
+			}
+		default:
+			t.Fatalf("unknown marker type %d", marker.Type)
+		}
+		if marker.Type == markerEOS {
+			break
+		}
+		pos += int(marker.NumSectors) * sectorSize
+	}
+
+	// rebuild the disk as a reader would, through the grain directory
+	tables := ((capacity+grainSectors-1)/grainSectors + gtEntries - 1) / gtEntries
+	if len(gts) != int(tables) {
+		t.Fatalf("got %d grain tables, want %d", len(gts), tables)
+	}
+	disk := make([]byte, capacity*sectorSize)
+	for i := int64(0); i < tables; i++ {
+		gt := uint64(binary.LittleEndian.Uint32(b[int(gdOffset)*sectorSize+int(i)*4:]))
+		if !gts[gt] {
+			t.Fatalf("grain directory entry %d points at sector %d rather than a grain table", i, gt)
+		}
+		for j := int64(0); j < gtEntries; j++ {
+			sector := uint64(binary.LittleEndian.Uint32(b[int(gt)*sectorSize+int(j)*4:]))
+			if sector == 0 {
+				continue
+			}
+			g := grains[sector]
+			lba := (i*gtEntries + j) * grainSectors
+			if g == nil || g.used || g.lba != uint64(lba) {
+				t.Fatalf("grain table entry for LBA %d points at sector %d", lba, sector)
+			}
+			g.used = true
+			copy(disk[lba*sectorSize:], g.data)
+		}
+	}
+	for sector, g := range grains {
+		if !g.used {
+			t.Errorf("grain at sector %d is not in any grain table", sector)
+		}
+	}
+
+	return disk
+}
+
+func TestWriteStreamOptimized(t *testing.T) {
+	grain := func(fill byte) []byte { return bytes.Repeat([]byte{fill}, grainSize) }
+	zero := make([]byte, grainSize)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name        string
+		disk        []byte
+		size        int64 // if larger than disk
+		adapterType string
+	}{{
+		name:        "zero grains and a partial sector",
+		disk:        join(grain(1), zero, grain(2), bytes.Repeat([]byte{3}, 1000)),
+		adapterType: "lsilogic",
+	}, {
+		name:        "empty",
+		disk:        join(zero, zero),
+		adapterType: "ide",
+	}, {
+		name:        "several grain tables",
+		disk:        join(grain(1), make([]byte, gtEntries*grainSize), grain(2)),
+		adapterType: "buslogic",
+	}, {
+		name:        "short input",
+		disk:        grain(1),
+		size:        3*grainSize + 100,
+		adapterType: "lsilogic",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = int64(len(tt.disk))
+			}
+
+			var b bytes.Buffer
+			err := writeStreamOptimized(&b, bytes.NewReader(tt.disk), size, tt.adapterType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			capacity := (size + sectorSize - 1) / sectorSize
+			disk := readStreamOptimized(t, b.Bytes(), capacity, tt.adapterType)
+			if !isZero(disk[size:]) {
+				t.Error("data past the end of the disk")
+			}
+			want := append(append([]byte(nil), tt.disk...), make([]byte, size-int64(len(tt.disk)))...)
+			if !bytes.Equal(disk[:size], want) {
+				t.Error("disk read back differs from the one written")
+			}
+		})
+	}
+}
+
+func TestWriteStreamOptimizedTooLarge(t *testing.T) {
+	disk := bytes.Repeat([]byte{1}, grainSize+1)
+	err := writeStreamOptimized(ioutil.Discard, bytes.NewReader(disk), grainSize, "lsilogic")
+	if err == nil || err.Error() != fmt.Sprintf("disk is larger than %d bytes", grainSize) {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package progress
+
+import "errors"
+
+// StageWeight is a stage of a task and the share of the task it makes up.
+type StageWeight struct {
+	Name   string
+	Weight float64
+}
+
+// WeightedStages divides a task into stages run one after another, each
+// tracked by a weighted subtracker. The subtrackers are all created up
+// front, so the Fraction of the task does not jump as later stages are
+// reached, and the task itself counts no progress of its own: its Fraction
+// is derived from the stages alone.
+type WeightedStages struct {
+	pt      ProgressTracker
+	names   []string
+	stages  []ProgressTracker
+	current int
+}
+
+// NewWeightedStages initializes pt as operation and creates a subtracker of
+// it for each of stages, in order.
+func NewWeightedStages(pt ProgressTracker, operation string, stages ...StageWeight) *WeightedStages {
+	pt.Initialize(operation, 0, UnitFraction)
+
+	s := &WeightedStages{
+		pt:      pt,
+		current: -1,
+	}
+	for _, stage := range stages {
+		s.names = append(s.names, stage.Name)
+		s.stages = append(s.stages, pt.NewWeightedSubtracker(stage.Weight))
+	}
+	return s
+}
+
+// Next closes the current stage as complete, enters the next one and
+// returns its subtracker, which the caller must initialize.
+func (s *WeightedStages) Next() ProgressTracker {
+	if s.current+1 >= len(s.stages) {
+		panic(errors.New("no stages left"))
+	}
+	if s.current >= 0 {
+		s.stages[s.current].Close(nil)
+	}
+	s.current++
+	s.pt.SetStage(s.names[s.current])
+	return s.stages[s.current]
+}
+
+// Close closes every stage that is still open with err. It does not close
+// the task itself, so that it can be deferred by code that reports more of
+// the task after the stages end, such as cleaning up.
+func (s *WeightedStages) Close(err error) {
+	for _, stage := range s.stages {
+		stage.Close(err)
+	}
+}
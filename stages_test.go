@@ -0,0 +1,92 @@
+package progress
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWeightedStages(t *testing.T) {
+	pt := NewProgressTracker()
+	stages := NewWeightedStages(pt, "Testing.",
+		StageWeight{"Checking.", 1},
+		StageWeight{"Uploading.", 8},
+		StageWeight{"Finishing.", 1},
+	)
+
+	status := pt.Status()
+	if status.Operation != "Testing." || status.Total != 0 || len(status.Subtasks) != 3 || status.Fraction != 0 {
+		t.Fatalf("got status %+v before the first stage", status)
+	}
+
+	tests := []struct {
+		run      func(stage ProgressTracker)
+		stage    string
+		fraction float64
+	}{{
+		run:      func(st ProgressTracker) { st.Initialize("Checking.", 2, UnitStep); st.IncrementProgress(1) },
+		stage:    "Checking.",
+		fraction: 0.05,
+	}, {
+		run:      func(st ProgressTracker) { st.Initialize("Uploading.", 100, UnitBytes); st.IncrementProgress(25) },
+		stage:    "Uploading.",
+		fraction: 0.3,
+	}, {
+		run:      func(st ProgressTracker) { st.Initialize("Finishing.", 1, UnitStep) },
+		stage:    "Finishing.",
+		fraction: 0.9,
+	}}
+
+	for i, tt := range tests {
+		tt.run(stages.Next())
+
+		status := pt.Status()
+		if status.Stage != tt.stage || !closeTo(status.Fraction, tt.fraction) {
+			t.Errorf("stage %d: got stage %q at %v, want %q at %v", i, status.Stage, status.Fraction, tt.stage, tt.fraction)
+		}
+		if status.Progress != 0 {
+			t.Errorf("stage %d: task counted progress %v of its own", i, status.Progress)
+		}
+		for j := 0; j < i; j++ {
+			if !status.Subtasks[j].Finished || status.Subtasks[j].Error != nil {
+				t.Errorf("stage %d: earlier stage %d not closed as complete", i, j)
+			}
+		}
+	}
+
+	failure := errors.New("failed")
+	stages.Close(failure)
+	status = pt.Status()
+	if status.Finished {
+		t.Error("closing the stages closed the task")
+	}
+	if last := status.Subtasks[2]; !last.Finished || last.Error != failure {
+		t.Errorf("got last stage finished %v with error %v", last.Finished, last.Error)
+	}
+	if status.Subtasks[0].Error != nil {
+		t.Error("closing the stages replaced the result of a finished one")
+	}
+}
+
+func TestWeightedStagesUnreached(t *testing.T) {
+	pt := NewProgressTracker()
+	stages := NewWeightedStages(pt, "Testing.", StageWeight{"First.", 1}, StageWeight{"Second.", 1})
+	stages.Next().Initialize("First.", 1, UnitStep)
+
+	failure := errors.New("failed")
+	stages.Close(failure)
+	status := pt.Status()
+	for i, sub := range status.Subtasks {
+		if !sub.Finished || sub.Error != failure {
+			t.Errorf("stage %d left finished %v with error %v", i, sub.Finished, sub.Error)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Next past the last stage did not panic")
+		}
+	}()
+	stages = NewWeightedStages(NewProgressTracker(), "Testing.", StageWeight{"Only.", 1})
+	stages.Next()
+	stages.Next()
+}
@@ -0,0 +1,263 @@
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+// Event types
+const (
+	EventStage    EventType = "stage"    // the task entered a new stage
+	EventProgress EventType = "progress" // the task's progress changed
+	EventSubtask  EventType = "subtask"  // a subtask was added; Path leads to the new subtask
+	EventFinished EventType = "finished" // the task was closed, with or without an error
+)
+
+// Event is a change to a task or one of its subtasks, delivered to the
+// subscribers of the task and of each of its ancestors.
+type Event struct {
+	Type EventType `json:"type"`
+
+	// Path holds the index of each subtask on the way from the subscribed
+	// task to the one that changed, so it is empty for a change to the
+	// subscribed task itself.
+	Path []int `json:"path"`
+
+	// Status is a snapshot of the task that changed, taken when the event
+	// is delivered for progress events and when the change was made for
+	// any other.
+	Status *Status `json:"status"`
+}
+
+// event is an Event on its way to a subscriber. The snapshot of a progress
+// event is only taken when it is delivered, so that throttled events cost
+// nothing and report the latest progress.
+type event struct {
+	typ      EventType
+	path     []int
+	task     *status
+	snapshot *Status
+}
+
+// subscriber queues events for delivery by its own goroutine, so that a
+// slow consumer never holds up the task. Progress events for each task are
+// coalesced and delivered at most once per interval; any other event first
+// flushes the pending progress of its task, so events of a task are never
+// reordered, and the end of the subscribed task flushes all of it.
+type subscriber struct {
+	task     *status
+	interval time.Duration
+	deliver  func(Event) bool
+	closed   func()
+
+	lock    sync.Mutex
+	queue   []event
+	pending map[string]event
+	order   []string
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func pathKey(path []int) string {
+	return fmt.Sprint(path)
+}
+
+// notify queues e for delivery.
+func (sub *subscriber) notify(e event) {
+	sub.lock.Lock()
+	key := pathKey(e.path)
+	if e.typ == EventProgress && sub.interval > 0 {
+		if _, ok := sub.pending[key]; !ok {
+			sub.order = append(sub.order, key)
+		}
+		sub.pending[key] = e
+	} else if e.typ == EventFinished && len(e.path) == 0 {
+		// nothing is delivered after the subscribed task finishes, so all
+		// of the pending progress goes first
+		for _, k := range sub.order {
+			sub.queue = append(sub.queue, sub.pending[k])
+		}
+		sub.pending = make(map[string]event)
+		sub.order = nil
+		sub.queue = append(sub.queue, e)
+	} else {
+		if p, ok := sub.pending[key]; ok {
+			sub.queue = append(sub.queue, p)
+			delete(sub.pending, key)
+			for i, k := range sub.order {
+				if k == key {
+					sub.order = append(sub.order[:i], sub.order[i+1:]...)
+					break
+				}
+			}
+		}
+		sub.queue = append(sub.queue, e)
+	}
+	sub.lock.Unlock()
+
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the queued events, along with the pending progress events
+// if flush is set.
+func (sub *subscriber) take(flush bool) []event {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	if flush {
+		for _, key := range sub.order {
+			sub.queue = append(sub.queue, sub.pending[key])
+		}
+		sub.pending = make(map[string]event)
+		sub.order = nil
+	}
+
+	q := sub.queue
+	sub.queue = nil
+	return q
+}
+
+// run delivers events until the subscribed task finishes or the
+// subscription is cancelled.
+func (sub *subscriber) run() {
+	defer sub.closed()
+
+	var tick <-chan time.Time
+	if sub.interval > 0 {
+		t := time.NewTicker(sub.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		flush := false
+		select {
+		case <-sub.done:
+			return
+		case <-sub.wake:
+		case <-tick:
+			flush = true
+		}
+
+		for _, e := range sub.take(flush) {
+			if e.snapshot == nil {
+				e.snapshot = e.task.Status()
+			}
+			if !sub.deliver(Event{Type: e.typ, Path: e.path, Status: e.snapshot}) {
+				return
+			}
+			if e.typ == EventFinished && len(e.path) == 0 {
+				sub.cancel()
+				return
+			}
+		}
+	}
+}
+
+// cancel ends the subscription.
+func (sub *subscriber) cancel() {
+	sub.once.Do(func() {
+		sub.task.lock.Lock()
+		for i, x := range sub.task.subscribers {
+			if x == sub {
+				sub.task.subscribers = append(sub.task.subscribers[:i], sub.task.subscribers[i+1:]...)
+				break
+			}
+		}
+		sub.task.lock.Unlock()
+		close(sub.done)
+	})
+}
+
+func newSubscriber(s *status, interval time.Duration) *subscriber {
+	return &subscriber{
+		task:     s,
+		interval: interval,
+		pending:  make(map[string]event),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// subscribe attaches sub to s and starts delivering its events.
+func (s *status) subscribe(sub *subscriber) {
+	s.lock.Lock()
+	finished := s.data.Finished
+	if !finished {
+		s.subscribers = append(s.subscribers, sub)
+	}
+	s.lock.Unlock()
+
+	// a task that has already finished only has its ending to report
+	if finished {
+		sub.notify(event{typ: EventFinished, task: s, snapshot: s.Status()})
+	}
+
+	go sub.run()
+}
+
+func (s *status) Subscribe(interval time.Duration) (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+	sub := newSubscriber(s, interval)
+	sub.deliver = func(e Event) bool {
+		select {
+		case ch <- e:
+			return true
+		case <-sub.done:
+			return false
+		}
+	}
+	sub.closed = func() {
+		close(ch)
+	}
+	s.subscribe(sub)
+
+	return ch, sub.cancel
+}
+
+func (s *status) SubscribeFunc(interval time.Duration, fn func(Event)) func() {
+	sub := newSubscriber(s, interval)
+	sub.deliver = func(e Event) bool {
+		fn(e)
+		return true
+	}
+	sub.closed = func() {}
+	s.subscribe(sub)
+
+	return sub.cancel
+}
+
+// emit passes e to the subscribers of s and of each of its ancestors. The
+// caller must not hold the lock of s.
+func (s *status) emit(typ EventType, snapshot bool) {
+	e := event{
+		typ:  typ,
+		task: s,
+	}
+
+	for t := s; t != nil; t = t.parent {
+		t.lock.Lock()
+		subs := make([]*subscriber, len(t.subscribers))
+		copy(subs, t.subscribers)
+		t.lock.Unlock()
+
+		if len(subs) > 0 && snapshot && e.snapshot == nil {
+			e.snapshot = s.Status()
+		}
+		for _, sub := range subs {
+			sub.notify(e)
+		}
+
+		if t.parent != nil {
+			e.path = append([]int{t.index}, e.path...)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package progress
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// never is a throttling interval long enough that pending progress is only
+// delivered when another event flushes it.
+const never = time.Hour
+
+// next returns the next event from ch, failing the test if there is none.
+func next(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription closed early")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	return Event{}
+}
+
+// expectClosed fails the test unless ch is closed without delivering more
+// events.
+func expectClosed(t *testing.T, ch <-chan Event) {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if ok {
+			t.Fatalf("got %s event at %v after the end", e.Type, e.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not closed")
+	}
+}
+
+// describe summarizes e as its type and path. The progress an event
+// reports is left out, since its snapshot is only taken when it is
+// delivered.
+func describe(e Event) string {
+	return fmt.Sprintf("%s %v", e.Type, e.Path)
+}
+
+func TestSubscribeThrottling(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		run      func(pt ProgressTracker)
+		want     []string
+	}{{
+		name:     "every change",
+		interval: 0,
+		run: func(pt ProgressTracker) {
+			pt.IncrementProgress(1)
+			pt.IncrementProgress(1)
+			pt.Close(nil)
+		},
+		want: []string{"progress []", "progress []", "finished []"},
+	}, {
+		name:     "coalesced",
+		interval: never,
+		run: func(pt ProgressTracker) {
+			pt.IncrementProgress(1)
+			pt.IncrementProgress(1)
+			pt.IncrementProgress(1)
+			pt.SetStage("Stage.")
+			pt.Close(nil)
+		},
+		want: []string{"progress []", "stage []", "finished []"},
+	}, {
+		name:     "coalesced per path",
+		interval: never,
+		run: func(pt ProgressTracker) {
+			a := pt.NewSubtracker()
+			b := pt.NewSubtracker()
+			pt.IncrementProgress(1)
+			a.IncrementProgress(1)
+			b.IncrementProgress(1)
+			a.IncrementProgress(1)
+			a.SetStage("Stage.")
+			b.IncrementProgress(1)
+			b.Close(nil)
+			pt.IncrementProgress(1)
+			pt.Close(nil)
+		},
+		want: []string{
+			"subtask [0]", "subtask [1]",
+			"progress [0]", "stage [0]",
+			"progress [1]", "finished [1]",
+			"progress []", "finished []",
+		},
+	}, {
+		name:     "flushed when the task finishes",
+		interval: never,
+		run: func(pt ProgressTracker) {
+			a := pt.NewSubtracker()
+			b := a.NewSubtracker()
+			b.IncrementProgress(1)
+			pt.IncrementProgress(1)
+			a.IncrementProgress(1)
+			pt.Close(nil)
+		},
+		want: []string{
+			"subtask [0]", "subtask [0 0]",
+			"progress [0 0]", "progress []", "progress [0]",
+			"finished []",
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := NewProgressTracker()
+			ch, cancel := pt.Subscribe(tt.interval)
+			defer cancel()
+
+			tt.run(pt)
+
+			var got []string
+			for e := range ch {
+				got = append(got, describe(e))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeInterval(t *testing.T) {
+	pt := NewProgressTracker()
+	ch, cancel := pt.Subscribe(10 * time.Millisecond)
+	defer cancel()
+
+	pt.IncrementProgress(1)
+	pt.IncrementProgress(1)
+
+	// pending progress is delivered once the interval passes, without
+	// waiting for another event
+	if e := next(t, ch); describe(e) != "progress []" || e.Status.Progress != 2 {
+		t.Errorf("got %s of %v, want progress [] of 2", describe(e), e.Status.Progress)
+	}
+}
+
+func TestSubscribePath(t *testing.T) {
+	pt := NewProgressTracker()
+	pt.NewSubtracker()
+	b := pt.NewSubtracker()
+
+	root, cancelRoot := pt.Subscribe(0)
+	defer cancelRoot()
+	middle, cancelMiddle := b.Subscribe(0)
+	defer cancelMiddle()
+
+	c := b.NewSubtracker()
+	leaf, cancelLeaf := c.Subscribe(0)
+	defer cancelLeaf()
+
+	c.SetStage("Stage.")
+
+	tests := []struct {
+		ch   <-chan Event
+		want []string
+	}{
+		{root, []string{"subtask [1 0]", "stage [1 0]"}},
+		{middle, []string{"subtask [0]", "stage [0]"}},
+		{leaf, []string{"stage []"}},
+	}
+	for i, tt := range tests {
+		var got []string
+		for range tt.want {
+			e := next(t, tt.ch)
+			got = append(got, describe(e))
+			if e.Status.Stage != "" && e.Status.Stage != "Stage." {
+				t.Errorf("subscriber %d: got status of stage %q", i, e.Status.Stage)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("subscriber %d: got events %q, want %q", i, got, tt.want)
+		}
+	}
+
+	// the end of a subtask does not end subscriptions to its ancestors
+	c.Close(nil)
+	if e := next(t, leaf); describe(e) != "finished []" {
+		t.Errorf("got %s, want finished []", describe(e))
+	}
+	expectClosed(t, leaf)
+	if e := next(t, middle); describe(e) != "finished [0]" {
+		t.Errorf("got %s, want finished [0]", describe(e))
+	}
+	if e := next(t, root); describe(e) != "finished [1 0]" {
+		t.Errorf("got %s, want finished [1 0]", describe(e))
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	pt := NewProgressTracker()
+	ch, cancel := pt.Subscribe(0)
+
+	pt.IncrementProgress(1)
+	cancel()
+	cancel()
+
+	// events queued before cancelling may or may not be delivered, but the
+	// channel is closed without being drained
+	for range ch {
+	}
+
+	pt.IncrementProgress(1)
+	pt.SetStage("Stage.")
+	pt.Close(nil)
+
+	// SubscribeFunc stops calling fn once cancelled
+	calls := make(chan Event, 16)
+	pt = NewProgressTracker()
+	cancel = pt.SubscribeFunc(0, func(e Event) { calls <- e })
+	cancel()
+	pt.IncrementProgress(1)
+	pt.Close(nil)
+	time.Sleep(10 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Errorf("got %d events after cancelling", len(calls))
+	}
+}
+
+func TestSubscribeFinished(t *testing.T) {
+	failure := errors.New("failed")
+
+	pt := NewProgressTracker()
+	pt.Initialize("Testing.", 10, UnitStep)
+	pt.SetProgress(4)
+	pt.Close(failure)
+
+	ch, cancel := pt.Subscribe(never)
+	defer cancel()
+
+	e := next(t, ch)
+	if describe(e) != "finished []" || !e.Status.Finished || e.Status.Error != failure || e.Status.Progress != 4 {
+		t.Errorf("got %s with status %+v", describe(e), e.Status)
+	}
+	expectClosed(t, ch)
+
+	calls := make(chan Event, 16)
+	pt.SubscribeFunc(0, func(e Event) { calls <- e })
+	if e := next(t, calls); describe(e) != "finished []" || e.Status.Error != failure {
+		t.Errorf("got %s with error %v", describe(e), e.Status.Error)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Errorf("got %d more events", len(calls))
+	}
+}
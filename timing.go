@@ -0,0 +1,107 @@
+package progress
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// rateTimeConstant is the time constant of the exponential moving
+	// average that smooths the rate of progress. Progress made this long ago
+	// counts for about a third as much as progress made now.
+	rateTimeConstant = 5 * time.Second
+
+	// minSampleInterval is the shortest interval the rate is measured over.
+	// Updates closer together than this are folded into the next sample.
+	minSampleInterval = 250 * time.Millisecond
+)
+
+// Stage is an entry in the stage history of a task.
+type Stage struct {
+	Name     string        `json:"name"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"` // Time spent in the stage so far, if it is the current stage. Encoded in JSON as nanoseconds.
+}
+
+// start records the time the task started, unless it already has. The
+// caller must hold the lock.
+func (s *status) start(now time.Time) {
+	if !s.data.Started.IsZero() {
+		return
+	}
+	s.data.Started = now
+	s.sampled = now
+	s.sampledProgress = s.data.Progress
+}
+
+// enterStage records the start of the stage name, ending the current stage.
+// Setting the stage the task is already in does not start a new one. The
+// caller must hold the lock.
+func (s *status) enterStage(name string, now time.Time) {
+	if n := len(s.data.Stages); n > 0 && s.data.Stages[n-1].Name == name {
+		return
+	}
+	s.endStage(now)
+	s.data.Stages = append(s.data.Stages, Stage{
+		Name:    name,
+		Started: now,
+	})
+}
+
+// endStage records the duration of the current stage. The caller must hold
+// the lock.
+func (s *status) endStage(now time.Time) {
+	if n := len(s.data.Stages); n > 0 {
+		s.data.Stages[n-1].Duration = now.Sub(s.data.Stages[n-1].Started)
+	}
+}
+
+// smoothRate folds the rate measured over an interval of dt into the
+// smoothed rate.
+func smoothRate(rate, measured float64, dt time.Duration) float64 {
+	alpha := 1 - math.Exp(-dt.Seconds()/rateTimeConstant.Seconds())
+	return math.Max(0, rate+alpha*(measured-rate))
+}
+
+// sample updates the smoothed rate with the progress made since the last
+// sample. The caller must hold the lock.
+func (s *status) sample(now time.Time) {
+	dt := now.Sub(s.sampled)
+	if dt < minSampleInterval {
+		return
+	}
+
+	measured := (s.data.Progress - s.sampledProgress) / dt.Seconds()
+	if s.rated {
+		s.rate = smoothRate(s.rate, measured, dt)
+	} else {
+		s.rate = math.Max(0, measured)
+		s.rated = true
+	}
+	s.sampled = now
+	s.sampledProgress = s.data.Progress
+}
+
+// timing fills in the timing fields of a snapshot of the task taken at now.
+// The rate decays while no progress is made, so a stalled task does not
+// keep reporting the rate it last had. The caller must hold the lock.
+func (s *status) timing(snapshot *Status, now time.Time) {
+	snapshot.Stages = append([]Stage(nil), s.data.Stages...)
+	if snapshot.Finished {
+		return
+	}
+
+	if n := len(snapshot.Stages); n > 0 {
+		snapshot.Stages[n-1].Duration = now.Sub(snapshot.Stages[n-1].Started)
+	}
+
+	rate := s.rate
+	if dt := now.Sub(s.sampled); s.rated && dt >= minSampleInterval {
+		rate = smoothRate(rate, (s.data.Progress-s.sampledProgress)/dt.Seconds(), dt)
+	}
+	snapshot.Rate = rate
+
+	if snapshot.Total > 0 && rate > 0 && snapshot.Progress < snapshot.Total {
+		snapshot.ETASeconds = (snapshot.Total - snapshot.Progress) / rate
+	}
+}
@@ -0,0 +1,230 @@
+package progress
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when told to.
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// newTestTracker returns a tracker, and any subtrackers it creates, timed by
+// c.
+func newTestTracker(c *testClock) *status {
+	s := newStatus()
+	s.clock = c.Now
+	return s
+}
+
+// decay is how much of the smoothed rate is left after rateTimeConstant.
+var decay = math.Exp(-1)
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestSmoothRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		measured float64
+		dt       time.Duration
+		want     float64
+	}{
+		{"no time passed", 100, 500, 0, 100},
+		{"one time constant", 0, 100, rateTimeConstant, 100 * (1 - decay)},
+		{"slowing down", 100, 0, rateTimeConstant, 100 * decay},
+		{"steady", 100, 100, time.Second, 100},
+		{"long interval", 100, 40, 100 * rateTimeConstant, 40},
+		{"never negative", 10, -100, rateTimeConstant, 0},
+	}
+
+	for _, tt := range tests {
+		if got := smoothRate(tt.rate, tt.measured, tt.dt); !closeTo(got, tt.want) {
+			t.Errorf("%s: got rate %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateAndETA(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(pt ProgressTracker, c *testClock)
+		rate float64
+		eta  float64 // seconds
+	}{{
+		name: "no sample yet",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 1000, UnitBytes)
+			c.advance(100 * time.Millisecond)
+			pt.IncrementProgress(100)
+		},
+	}, {
+		name: "first sample",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 1000, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(100)
+		},
+		rate: 100,
+		eta:  9,
+	}, {
+		name: "written",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 1000, UnitBytes)
+			c.advance(2 * time.Second)
+			pt.Write(make([]byte, 500))
+		},
+		rate: 250,
+		eta:  2,
+	}, {
+		name: "smoothed",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 10000, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(100)
+			c.advance(rateTimeConstant)
+			pt.IncrementProgress(1100)
+		},
+		rate: 100 + (1-decay)*120,
+		eta:  8800 / (100 + (1-decay)*120),
+	}, {
+		name: "updates folded into the next sample",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 1000, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(100)
+			c.advance(100 * time.Millisecond)
+			pt.IncrementProgress(50)
+		},
+		rate: 100,
+		eta:  8.5,
+	}, {
+		name: "stalled",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 1000, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(100)
+			c.advance(rateTimeConstant)
+		},
+		rate: 100 * decay,
+		eta:  900 / (100 * decay),
+	}, {
+		name: "unknown total",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 0, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(100)
+		},
+		rate: 100,
+	}, {
+		name: "past total",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 100, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(200)
+		},
+		rate: 200,
+	}, {
+		name: "going backwards",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 100, UnitPercent)
+			c.advance(time.Second)
+			pt.SetProgress(10)
+			c.advance(rateTimeConstant)
+			pt.SetProgress(0)
+		},
+		rate: 10 + (1-decay)*(-2-10),
+		eta:  100 / (10 + (1-decay)*(-2-10)),
+	}, {
+		name: "finished",
+		run: func(pt ProgressTracker, c *testClock) {
+			pt.Initialize("", 1000, UnitBytes)
+			c.advance(time.Second)
+			pt.IncrementProgress(100)
+			pt.Close(nil)
+		},
+	}}
+
+	for _, tt := range tests {
+		c := newTestClock()
+		pt := newTestTracker(c)
+		tt.run(pt, c)
+
+		status := pt.Status()
+		if !closeTo(status.Rate, tt.rate) {
+			t.Errorf("%s: got rate %v, want %v", tt.name, status.Rate, tt.rate)
+		}
+		if !closeTo(status.ETASeconds, tt.eta) {
+			t.Errorf("%s: got ETA of %vs, want %vs", tt.name, status.ETASeconds, tt.eta)
+		}
+	}
+}
+
+func TestStageHistory(t *testing.T) {
+	c := newTestClock()
+	start := c.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	pt := newTestTracker(c)
+	c.advance(time.Second)
+	pt.SetStage("First.")
+	c.advance(2 * time.Second)
+	pt.SetStage("First.")
+	c.advance(time.Second)
+	pt.SetStage("Second.")
+	sub := pt.NewSubtracker()
+	c.advance(3 * time.Second)
+	sub.SetStage("Substage.")
+
+	status := pt.Status()
+	if !status.Started.Equal(at(time.Second)) || !status.Ended.IsZero() {
+		t.Errorf("got task from %v to %v, want from %v", status.Started, status.Ended, at(time.Second))
+	}
+	want := []Stage{
+		{Name: "First.", Started: at(time.Second), Duration: 3 * time.Second},
+		{Name: "Second.", Started: at(4 * time.Second), Duration: 3 * time.Second},
+	}
+	if !reflect.DeepEqual(status.Stages, want) {
+		t.Errorf("got stages %+v, want %+v", status.Stages, want)
+	}
+	if sub := status.Subtasks[0]; !sub.Started.Equal(at(7*time.Second)) || len(sub.Stages) != 1 {
+		t.Errorf("got subtask started %v with stages %+v", sub.Started, sub.Stages)
+	}
+
+	c.advance(time.Second)
+	pt.Close(errors.New("failed"))
+	c.advance(time.Hour)
+
+	status = pt.Status()
+	if !status.Ended.Equal(at(8 * time.Second)) {
+		t.Errorf("got task ended at %v, want %v", status.Ended, at(8*time.Second))
+	}
+	want[1].Duration = 4 * time.Second
+	if !reflect.DeepEqual(status.Stages, want) {
+		t.Errorf("got stages %+v once finished, want %+v", status.Stages, want)
+	}
+}
@@ -2,7 +2,9 @@ package progress
 
 import (
 	"errors"
+	"math"
 	"sync"
+	"time"
 )
 
 // Units describe what is being tracked.
@@ -17,25 +19,66 @@ const (
 	UnitSecond   Units = "seconds"
 )
 
+// status is the ProgressTracker implementation. Every access to data,
+// subtasks and listeners holds lock, so a tracker may be updated from
+// several goroutines at once.
 type status struct {
-	data Status
+	lock      sync.Mutex
+	data      Status
+	weight    float64
+	subtasks  []*status
+	join      chan error
+	listeners int
+
+	// the parent of a subtask and its index among the parent's subtasks,
+	// which never change once the subtask is created
+	parent *status
+	index  int
+
+	subscribers []*subscriber
+
+	// the smoothed rate of progress, and the progress at the time it was
+	// last sampled
+	rate            float64
+	rated           bool
+	sampled         time.Time
+	sampledProgress float64
+
+	// clock returns the current time; subtasks share the clock of their
+	// parent
+	clock func() time.Time
 }
 
-// Status holds information about the current status of a task.
+// Status holds information about the current status of a task. A Status
+// returned by ProgressTracker.Status is a snapshot: it does not change as
+// the task progresses.
+//
+// Fraction is the completed fraction of the task, between 0 and 1, whatever
+// its units. A task with weighted subtasks derives it from theirs, each
+// counting in proportion to its weight; any other task derives it from
+// Progress and Total, or reports 0 while its total is unknown. A task that
+// finished without an error is always complete.
+//
+// Rate is the smoothed rate of progress in Units per second, such as bytes
+// per second for UnitBytes, and ETASeconds the seconds left to reach Total
+// at that rate, or 0 if either is unknown. Neither is reported once the task has
+// finished.
 type Status struct {
-	Operation   string  `json:"operation"`
-	Stage       string  `json:"stage"`
-	Progress    float64 `json:"progress"`
-	Total       float64 `json:"total"`
-	Units       Units   `json:"units"`
-	Error       error   `json:"error"`
-	Finished    bool    `json:"finished"`
-	initialized bool
-	join        chan error
-	lock        sync.Mutex
-	listeners   int
-	id          string
-	Subtasks    []ProgressTracker `json:"subtasks"`
+	Operation  string    `json:"operation"`
+	Stage      string    `json:"stage"`
+	Progress   float64   `json:"progress"`
+	Total      float64   `json:"total"`
+	Units      Units     `json:"units"`
+	Fraction   float64   `json:"fraction"`
+	Weight     float64   `json:"weight,omitempty"`
+	Rate       float64   `json:"rate"`
+	ETASeconds float64   `json:"eta_seconds"`
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+	Stages     []Stage   `json:"stages"`
+	Error      error     `json:"error"`
+	Finished   bool      `json:"finished"`
+	Subtasks   []*Status `json:"subtasks"`
 }
 
 // ProgressTracker allows complex and modularized progress tracking by dividing
@@ -73,101 +116,193 @@ type ProgressTracker interface {
 	// with.
 	Join() <-chan error
 
-	// NewSubtracker creates a new subtracker to track a sub-task.
+	// NewSubtracker creates a new subtracker to track a sub-task. It does
+	// not contribute to the Fraction of its parent.
 	NewSubtracker() ProgressTracker
 
+	// NewWeightedSubtracker creates a new subtracker to track a sub-task
+	// that makes up weight of its parent. Once a task has a weighted
+	// subtask, its Fraction is derived from theirs rather than from its own
+	// progress. Weights are relative, so 70, 25 and 5 divide a task the
+	// same way as 0.7, 0.25 and 0.05.
+	NewWeightedSubtracker(weight float64) ProgressTracker
+
 	// Status returns a marshallable struct containing a full summary of
 	// the task's progress, including all subtasks.data.
 	Status() *Status
+
+	// Subscribe returns a channel of the changes to the task and all of
+	// its subtasks, and a function that cancels the subscription. Progress
+	// events for each task are delivered at most once per interval, or for
+	// every change if interval is 0; other events are never dropped. The
+	// channel is closed after the task finishes or once the subscription
+	// is cancelled, and must be drained until then.
+	Subscribe(interval time.Duration) (<-chan Event, func())
+
+	// SubscribeFunc is Subscribe, calling fn with each event rather than
+	// sending it on a channel. fn is called from a goroutine of its own,
+	// one event at a time.
+	SubscribeFunc(interval time.Duration, fn func(Event)) func()
 }
 
 // NewProgressTracker creates a new uninitialized progress tracker.
 func NewProgressTracker() ProgressTracker {
+	return newStatus()
+}
+
+func newStatus() *status {
 	x := new(status)
-	x.data.join = make(chan error)
+	x.join = make(chan error)
+	x.clock = time.Now
 	return x
 }
 
-func (s *status) Initialize(operation string, total float64, units Units) {
-	if s.data.initialized {
-		panic(errors.New("task already initialized"))
+// update applies fn to the status of a task that has not finished, and
+// reports the change to subscribers as an event of type typ.
+func (s *status) update(typ EventType, fn func(data *Status)) {
+	s.lock.Lock()
+	if s.data.Finished {
+		s.lock.Unlock()
+		panic(errors.New("task already finished"))
 	}
+	now := s.clock()
+	s.start(now)
+	fn(&s.data)
+	s.sample(now)
+	s.lock.Unlock()
+
+	s.emit(typ, typ != EventProgress)
+}
+
+func (s *status) Initialize(operation string, total float64, units Units) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.data.Operation = operation
 	s.data.Total = total
 	s.data.Units = units
+	s.start(s.clock())
 }
 
 func (s *status) Close(err error) {
+	s.lock.Lock()
 	if s.data.Finished {
+		s.lock.Unlock()
 		return
 	}
-	s.data.lock.Lock()
+	now := s.clock()
+	s.start(now)
+	s.endStage(now)
+	s.data.Ended = now
 	s.data.Finished = true
-	s.data.lock.Unlock()
 	s.data.Error = err
-	done := make(chan bool)
-	for i := 0; i < s.data.listeners; i++ {
-		go func() {
-			s.data.join <- err
-			done <- true
-		}()
-	}
-	for i := 0; i < s.data.listeners; i++ {
-		<-done
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	s.emit(EventFinished, true)
+
+	// no listeners are added once the task has finished, so each of those
+	// counted will receive err before the channel is closed
+	for i := 0; i < listeners; i++ {
+		s.join <- err
 	}
-	close(done)
-	close(s.data.join)
+	close(s.join)
 }
 
 func (s *status) SetStage(stage string) {
-	if s.data.Finished {
-		panic(errors.New("task already finished"))
-	}
-	s.data.Stage = stage
+	s.update(EventStage, func(data *Status) {
+		data.Stage = stage
+		s.enterStage(stage, s.clock())
+	})
 }
 
 func (s *status) IncrementProgress(d float64) {
-	if s.data.Finished {
-		panic(errors.New("task already finished"))
-	}
-	s.data.Progress += d
+	s.update(EventProgress, func(data *Status) {
+		data.Progress += d
+	})
 }
 
 func (s *status) SetProgress(x float64) {
-	if s.data.Finished {
-		panic(errors.New("task already finished"))
-	}
-	s.data.Progress = x
+	s.update(EventProgress, func(data *Status) {
+		data.Progress = x
+	})
 }
 
 func (s *status) Write(p []byte) (n int, err error) {
+	s.lock.Lock()
+	now := s.clock()
+	s.start(now)
 	s.data.Progress += float64(len(p))
+	s.sample(now)
+	s.lock.Unlock()
+
+	s.emit(EventProgress, false)
 	return len(p), nil
 }
 
 func (s *status) Join() <-chan error {
-	s.data.lock.Lock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if s.data.Finished {
-		s.data.lock.Unlock()
-		ch := make(chan error)
-		go func() {
-			ch <- s.data.Error
-			close(ch)
-		}()
+		ch := make(chan error, 1)
+		ch <- s.data.Error
+		close(ch)
 		return ch
 	}
 
-	s.data.listeners++
-	s.data.lock.Unlock()
-	return s.data.join
+	s.listeners++
+	return s.join
 }
 
 func (s *status) NewSubtracker() ProgressTracker {
-	x := NewProgressTracker()
-	s.data.Subtasks = append(s.data.Subtasks, x)
+	return s.NewWeightedSubtracker(0)
+}
+
+func (s *status) NewWeightedSubtracker(weight float64) ProgressTracker {
+	if weight < 0 {
+		panic(errors.New("negative subtask weight"))
+	}
+	x := newStatus()
+	x.weight = weight
+	x.parent = s
+	x.clock = s.clock
+	s.lock.Lock()
+	x.index = len(s.subtasks)
+	s.subtasks = append(s.subtasks, x)
+	s.lock.Unlock()
+
+	x.emit(EventSubtask, true)
 	return x
 }
 
+// Status returns a copy of the status of the task and its subtasks. Each
+// task is copied under its own lock, so the snapshot of a subtask may be
+// slightly newer than that of its parent.
 func (s *status) Status() *Status {
-	return &s.data
+	s.lock.Lock()
+	snapshot := s.data
+	snapshot.Weight = s.weight
+	s.timing(&snapshot, s.clock())
+	subtasks := make([]*status, len(s.subtasks))
+	copy(subtasks, s.subtasks)
+	s.lock.Unlock()
+
+	snapshot.Subtasks = nil
+	var weights, weighted float64
+	for _, sub := range subtasks {
+		x := sub.Status()
+		snapshot.Subtasks = append(snapshot.Subtasks, x)
+		weights += x.Weight
+		weighted += x.Weight * x.Fraction
+	}
+
+	switch {
+	case snapshot.Finished && snapshot.Error == nil:
+		snapshot.Fraction = 1
+	case weights > 0:
+		snapshot.Fraction = weighted / weights
+	case snapshot.Total > 0:
+		snapshot.Fraction = math.Max(0, math.Min(1, snapshot.Progress/snapshot.Total))
+	}
+
+	return &snapshot
 }
@@ -0,0 +1,248 @@
+package progress
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentUpdates(t *testing.T) {
+	const (
+		workers = 16
+		updates = 500
+	)
+
+	pt := NewProgressTracker()
+	pt.Initialize("Testing.", 2*workers*updates, UnitBytes)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := pt.NewSubtracker()
+			sub.Initialize("Working.", updates, UnitStep)
+			for j := 0; j < updates; j++ {
+				pt.Write([]byte{0})
+				pt.IncrementProgress(1)
+				sub.IncrementProgress(1)
+				if j%50 == 0 {
+					pt.SetStage("Stage.")
+					sub.SetStage("Substage.")
+					sub.NewSubtracker().Close(nil)
+				}
+				pt.Status()
+			}
+			sub.Close(nil)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < updates; i++ {
+			pt.Status()
+		}
+	}()
+
+	wg.Wait()
+
+	status := pt.Status()
+	if status.Progress != 2*workers*updates {
+		t.Errorf("got progress %v, want %v", status.Progress, 2*workers*updates)
+	}
+	if len(status.Subtasks) != workers {
+		t.Fatalf("got %d subtasks, want %d", len(status.Subtasks), workers)
+	}
+	for _, sub := range status.Subtasks {
+		if sub.Progress != updates || !sub.Finished || len(sub.Subtasks) != updates/50 {
+			t.Errorf("got subtask at %v with %d subtasks, finished %v", sub.Progress, len(sub.Subtasks), sub.Finished)
+		}
+	}
+}
+
+func TestCloseRacesJoin(t *testing.T) {
+	failure := errors.New("failed")
+
+	for i := 0; i < 100; i++ {
+		pt := NewProgressTracker()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- <-pt.Join()
+			}()
+		}
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pt.Close(failure)
+			}()
+		}
+		wg.Wait()
+
+		// joining after the task has finished still reports its error
+		errs <- <-pt.Join()
+		close(errs)
+
+		n := 0
+		for err := range errs {
+			if err != failure {
+				t.Fatalf("Join returned %v, want %v", err, failure)
+			}
+			n++
+		}
+		if n != 11 {
+			t.Fatalf("got %d errors from Join, want 11", n)
+		}
+	}
+}
+
+func TestStatusIsSnapshot(t *testing.T) {
+	pt := NewProgressTracker()
+	pt.Initialize("Testing.", 100, UnitBytes)
+	pt.SetStage("First.")
+	pt.IncrementProgress(10)
+	sub := pt.NewSubtracker()
+	sub.Initialize("Working.", 10, UnitStep)
+	sub.SetStage("Substage.")
+	sub.IncrementProgress(1)
+
+	snapshot := pt.Status()
+	before, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt.SetStage("Second.")
+	pt.IncrementProgress(10)
+	sub.SetStage("Another substage.")
+	sub.IncrementProgress(1)
+	sub.NewSubtracker()
+	pt.NewSubtracker()
+	sub.Close(nil)
+	pt.Close(errors.New("failed"))
+
+	after, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("snapshot changed from\n%s\nto\n%s", before, after)
+	}
+
+	if len(snapshot.Stages) != 1 || len(snapshot.Subtasks) != 1 || len(snapshot.Subtasks[0].Stages) != 1 {
+		t.Errorf("snapshot has %d stages and %d subtasks", len(snapshot.Stages), len(snapshot.Subtasks))
+	}
+}
+
+func TestFraction(t *testing.T) {
+	failure := errors.New("failed")
+
+	tests := []struct {
+		name  string
+		build func(pt ProgressTracker)
+		want  float64
+	}{{
+		name:  "unknown total",
+		build: func(pt ProgressTracker) { pt.Initialize("", 0, UnitBytes); pt.IncrementProgress(10) },
+		want:  0,
+	}, {
+		name:  "progress",
+		build: func(pt ProgressTracker) { pt.Initialize("", 200, UnitBytes); pt.IncrementProgress(50) },
+		want:  0.25,
+	}, {
+		name:  "past total",
+		build: func(pt ProgressTracker) { pt.Initialize("", 10, UnitStep); pt.SetProgress(12) },
+		want:  1,
+	}, {
+		name:  "negative",
+		build: func(pt ProgressTracker) { pt.Initialize("", 10, UnitStep); pt.SetProgress(-2) },
+		want:  0,
+	}, {
+		name:  "finished",
+		build: func(pt ProgressTracker) { pt.Initialize("", 10, UnitStep); pt.Close(nil) },
+		want:  1,
+	}, {
+		name:  "failed",
+		build: func(pt ProgressTracker) { pt.Initialize("", 10, UnitStep); pt.SetProgress(3); pt.Close(failure) },
+		want:  0.3,
+	}, {
+		name: "mixed units",
+		build: func(pt ProgressTracker) {
+			pt.Initialize("", 4, UnitStep)
+			bytes := pt.NewWeightedSubtracker(3)
+			bytes.Initialize("", 1000, UnitBytes)
+			bytes.IncrementProgress(500)
+			percent := pt.NewWeightedSubtracker(1)
+			percent.Initialize("", 100, UnitPercent)
+			percent.SetProgress(100)
+		},
+		want: 0.625,
+	}, {
+		name: "relative weights",
+		build: func(pt ProgressTracker) {
+			a := pt.NewWeightedSubtracker(0.7)
+			a.Close(nil)
+			b := pt.NewWeightedSubtracker(0.3)
+			b.Initialize("", 10, UnitStep)
+		},
+		want: 0.7,
+	}, {
+		name: "zero weight ignored",
+		build: func(pt ProgressTracker) {
+			pt.Initialize("", 10, UnitStep)
+			pt.SetProgress(9)
+			w := pt.NewWeightedSubtracker(2)
+			w.Initialize("", 4, UnitStep)
+			w.SetProgress(1)
+			pt.NewSubtracker().Close(nil)
+		},
+		want: 0.25,
+	}, {
+		name: "only zero weights",
+		build: func(pt ProgressTracker) {
+			pt.Initialize("", 10, UnitStep)
+			pt.SetProgress(4)
+			pt.NewSubtracker().Close(nil)
+			pt.NewWeightedSubtracker(0).Close(nil)
+		},
+		want: 0.4,
+	}, {
+		name: "one failed, one succeeded",
+		build: func(pt ProgressTracker) {
+			failed := pt.NewWeightedSubtracker(1)
+			failed.Initialize("", 100, UnitBytes)
+			failed.IncrementProgress(30)
+			failed.Close(failure)
+			succeeded := pt.NewWeightedSubtracker(1)
+			succeeded.Initialize("", 100, UnitBytes)
+			succeeded.Close(nil)
+		},
+		want: 0.65,
+	}, {
+		name: "nested",
+		build: func(pt ProgressTracker) {
+			a := pt.NewWeightedSubtracker(1)
+			a.NewWeightedSubtracker(1).Close(nil)
+			a.NewWeightedSubtracker(3)
+			b := pt.NewWeightedSubtracker(1)
+			b.Initialize("", 2, UnitStep)
+			b.IncrementProgress(1)
+		},
+		want: 0.375,
+	}}
+
+	for _, tt := range tests {
+		pt := NewProgressTracker()
+		tt.build(pt)
+		if got := pt.Status().Fraction; got != tt.want {
+			t.Errorf("%s: got fraction %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}